@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Ordering of items, for sorting lists.
+type itemLess func(a, b *node) bool
+
+func byLabel(a, b *node) bool {
+	return strings.ToLower(a.resolve().label) < strings.ToLower(b.resolve().label)
+}
+
+func byLabelNatural(a, b *node) bool {
+	return naturalLess(a.resolve().label, b.resolve().label)
+}
+
+func byKidCount(a, b *node) bool {
+	return len(a.resolve().sublist) < len(b.resolve().sublist)
+}
+
+// Compares strings the way a human would: case-insensitively, and with
+// runs of digits compared by their numeric value (so "item 9" comes before
+// "item 10").
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			var da, db string
+			da, a = splitDigits(a)
+			db, b = splitDigits(b)
+			// Longer number (sans leading zeros) is the larger one;
+			// same length numbers compare fine as strings.
+			da = strings.TrimLeft(da, "0")
+			db = strings.TrimLeft(db, "0")
+			if len(da) != len(db) {
+				return len(da) < len(db)
+			}
+			if da != db {
+				return da < db
+			}
+			continue
+		}
+		ra, sa := utf8.DecodeRuneInString(a)
+		rb, sb := utf8.DecodeRuneInString(b)
+		ra, rb = unicode.ToLower(ra), unicode.ToLower(rb)
+		if ra != rb {
+			return ra < rb
+		}
+		a, b = a[sa:], b[sb:]
+	}
+	return a == "" && b != ""
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// Splits leading digits off of s.
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// Returns list 'n' and, if 'recursive', all lists below it.
+func listsUnder(n *node, recursive bool) []*node {
+	lists := []*node{n}
+	if recursive {
+		for _, kid := range n.sublist {
+			lists = append(lists, listsUnder(kid, true)...)
+		}
+	}
+	return lists
+}
+
+// Sorts the current list (and with 'recursive', all its sublists too) as
+// a single undoable operation. The cursor stays on the same item.
+func (ds *dataStore) sortItems(less itemLess, reverse, recursive bool) {
+	if len(ds.currentList.sublist) == 0 {
+		Log("Nothing to sort.")
+		return
+	}
+	lists := listsUnder(ds.currentList, recursive)
+	ds.saveUndo("sort", lists...)
+
+	cmp := less
+	if reverse {
+		cmp = func(a, b *node) bool { return less(b, a) }
+	}
+	for _, l := range lists {
+		kids := l.sublist
+		sort.SliceStable(kids, func(i, j int) bool {
+			return cmp(kids[i], kids[j])
+		})
+	}
+
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(ds.currentItem))
+	ds.changedList(ds.currentList)
+}
+
+// What items must have in common to be duplicates: all but their sublists,
+// which get merged.
+type dedupeKey struct {
+	label, note, repeat string
+	due, scheduled      int64
+	priority            int
+}
+
+func dedupeKeyOf(n *node) dedupeKey {
+	return dedupeKey{n.label, n.note, n.repeat, n.due.Unix(), n.scheduled.Unix(), n.priority}
+}
+
+// Removes items on current list which repeat an earlier item (label, note,
+// dates and all), moving their sublists over to that earlier item.
+func (ds *dataStore) dedupeItems() {
+	kids := ds.currentList.sublist
+	first := make(map[dedupeKey]*node)
+	keeperOf := make(map[*node]*node) // dupe -> earlier item it repeats
+	dupes := []*node{}
+	for _, kid := range kids {
+		if ds.isFileList(kid) || isSpecialLabel(kid.label) || kid.link != nil ||
+			kid.enter != nil || kid.mount != nil || kid.query != "" {
+			// Never merge special lists, nor links, stand-ins, mounts
+			// or smart lists, whose sublists are not simply theirs.
+			continue
+		}
+		key := dedupeKeyOf(kid)
+		if keeper, ok := first[key]; ok {
+			dupes = append(dupes, keeper, kid)
+			keeperOf[kid] = keeper
+		} else {
+			first[key] = kid
+		}
+	}
+	if len(dupes) == 0 {
+		Log("No duplicates found.")
+		return
+	}
+	ds.saveUndo("dedupe", append([]*node{ds.currentList}, dupes...)...)
+	step := &ds.undo[len(ds.undo)-1]
+	step.tagged = make(map[*node]bool)
+	for _, n := range dupes {
+		step.tagged[n] = n.tagged
+	}
+
+	merged := make(map[*node]*node) // dupe -> node it was merged into
+	newKids := []*node{}
+	for _, kid := range kids {
+		keeper := keeperOf[kid]
+		if keeper == nil {
+			newKids = append(newKids, kid)
+			continue
+		}
+		// Keep Target pointing at the same items.
+		if ds.Mark.list == kid {
+			mark := *ds.Mark
+			step.mark = &mark
+			ds.Mark.list = keeper
+			ds.Mark.index += len(keeper.sublist)
+		}
+		for _, sub := range kid.sublist {
+			keeper.sublist = append(keeper.sublist, sub)
+			sub.parent = keeper
+		}
+		keeper.tagged = keeper.tagged || kid.tagged
+		kid.sublist = []*node{}
+		indexFor(ds.currentList).remove(kid)
+		kid.parent = nil
+		merged[kid] = keeper
+	}
+	ds.currentList.sublist = newKids
+	Log("Merged %d duplicate item(s).", len(merged))
+
+	if keeper, ok := merged[ds.currentItem]; ok {
+		ds.currentItem = keeper
+	}
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(ds.currentItem))
+	ds.changedList(ds.currentList)
+}
+
+// Puts items on current list in random order.
+func (ds *dataStore) shuffleItems() {
+	kids := ds.currentList.sublist
+	if len(kids) < 2 {
+		return
+	}
+	ds.saveUndo("shuffle", ds.currentList)
+	rand.Shuffle(len(kids), func(i, j int) {
+		kids[i], kids[j] = kids[j], kids[i]
+	})
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(ds.currentItem))
+	ds.changedList(ds.currentList)
+}
+
+// vim: fdm=syntax
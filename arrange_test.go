@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns items on 'l' labelled 's'.
+func itemsLabelled(l *node, s string) []*node {
+	items := []*node{}
+	for _, n := range l.sublist {
+		if n.label == s {
+			items = append(items, n)
+		}
+	}
+	return items
+}
+
+// Returns labels of items on 'l' other than special lists and stand-ins.
+func plainLabelsOf(b *dataStore, l *node) []string {
+	s := []string{}
+	for _, n := range l.sublist {
+		if !b.isFileList(n) && n.enter == nil {
+			s = append(s, n.label)
+		}
+	}
+	return s
+}
+
+func TestDedupe(t *testing.T) {
+	due := time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name   string
+		change func(b *dataStore, a *node)
+		want   []string
+	}{
+		{"same", func(b *dataStore, a *node) {}, []string{"a", "b"}},
+		{"note differs", func(b *dataStore, a *node) {
+			a.note = "keep me"
+		}, []string{"a", "b", "a"}},
+		{"due differs", func(b *dataStore, a *node) {
+			a.due = due
+		}, []string{"a", "b", "a"}},
+		{"priority differs", func(b *dataStore, a *node) {
+			a.priority = 1
+		}, []string{"a", "b", "a"}},
+		{"mount", func(b *dataStore, a *node) {
+			a.mount = newMount("other.lol")
+		}, []string{"a", "b", "a"}},
+		{"label of DONE", func(b *dataStore, a *node) {
+			a.label = LABEL_DONE
+		}, []string{"a", "b", LABEL_DONE}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBuffer(t, "a", "b", "a")
+			tt.change(b, itemsLabelled(b.root, "a")[1])
+			// The earlier plain item labelled as DONE must not take
+			// in the real one.
+			b.root.insertKid(0, newNode(LABEL_DONE))
+			done, trash := b.markDone.list, b.markTrash.list
+			b.currentList = b.root
+			b.dedupeItems()
+
+			got := plainLabelsOf(b, b.root)[1:]
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if b.root.indexOf(done) < 0 || b.root.indexOf(trash) < 0 {
+				t.Error("DONE or Trash merged away")
+			}
+		})
+	}
+}
+
+func TestSortByDate(t *testing.T) {
+	b := testBuffer(t, "none", "late", "early", "scheduled")
+	itemsLabelled(b.root, "late")[0].due = time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)
+	itemsLabelled(b.root, "early")[0].due = time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	itemsLabelled(b.root, "scheduled")[0].scheduled = time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)
+	b.currentList = b.root
+	b.sortItems(byDate, false, false)
+	got := plainLabelsOf(b, b.root)
+	want := []string{"early", "scheduled", "late", "none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+// Benchmarks, on a large made up tree, of what must stay fast as trees grow:
+// saving, loading, walking the tree, moving about a long list, and drawing
+// the panes. Run them before and after changes to any of those:
+//
+//	go test -run '^$' -bench . -benchmem
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jroimartin/gocui"
+)
+
+const (
+	// Items in the tree benchmarked on.
+	BENCH_NODES = 1000000
+	// Items on its longest list.
+	BENCH_LIST = 100000
+)
+
+// Returns a tree of about 'nodes' items, one list of which has 'list' items;
+// the rest nested some levels deep, with notes, dates etc. here and there.
+func benchTree(nodes, list int) fileTree {
+	root := newNode("root")
+	root.id = ROOT_ID
+	long := newNode("long list")
+	root.insertKid(0, long)
+	for i := 0; i < list; i++ {
+		long.sublist = append(long.sublist, newNode("item "+strconv.Itoa(i)))
+		long.sublist[i].parent = long
+	}
+
+	// The rest, ten to a list, breadth first.
+	due := today().AddDate(0, 0, 7)
+	lists := []*node{root}
+	for count := list + 1; count < nodes; count++ {
+		p := lists[0]
+		n := newNode("item " + strconv.Itoa(count) + " #tag")
+		switch {
+		case count%10 == 0:
+			n.note = "a note\non two lines"
+		case count%7 == 0:
+			n.due = due
+		case count%13 == 0:
+			n.priority = 2
+		case count%17 == 0:
+			n.note = "see " + refTo(long)
+		}
+		p.sublist = append(p.sublist, n)
+		n.parent = p
+		lists = append(lists, n)
+		if len(p.sublist) >= 10 {
+			lists = lists[1:]
+		}
+	}
+
+	done, trash := newNode(LABEL_DONE), newNode(LABEL_TRASH)
+	root.insertKid(len(root.sublist), done)
+	root.insertKid(len(root.sublist), trash)
+	return fileTree{root: root, done: done, trash: trash, lastId: lastNodeId}
+}
+
+var bench struct {
+	once sync.Once
+	tree fileTree
+	// The tree as saved.
+	data []byte
+}
+
+// Returns the tree benchmarked on, made on first call.
+func benchData(b *testing.B) (fileTree, []byte) {
+	bench.once.Do(func() {
+		bench.tree = benchTree(BENCH_NODES, BENCH_LIST)
+		var buf bytes.Buffer
+		if err := bench.tree.write(&buf); err != nil {
+			b.Fatal(err)
+		}
+		bench.data = buf.Bytes()
+	})
+	b.ResetTimer()
+	return bench.tree, bench.data
+}
+
+// Makes a buffer of the tree benchmarked on the current one, with cursor
+// halfway down its long list, and panes to draw it in.
+func benchBuffer(b *testing.B) *dataStore {
+	t, _ := benchData(b)
+	ds = &dataStore{filename: "bench.lol", root: t.root, Mark: &Target{}}
+	ds.markDone = &Target{t.done, 0, true}
+	ds.markTrash = &Target{t.trash, 0, true}
+	ds.currentList = t.root.sublist[0]
+	ds.setCurrentItemUsingIndex(BENCH_LIST / 2)
+	ds.freshIndex()
+
+	vd.editorLol = &LolEditor{}
+	g := &gocui.Gui{}
+	vd.paneMain, _ = g.SetView("main", 0, 0, 120, 50)
+	vd.paneInfo, _ = g.SetView("info", 0, 0, 40, 20)
+	b.ResetTimer()
+	return ds
+}
+
+func BenchmarkSave(b *testing.B) {
+	t, data := benchData(b)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		t.write(ioutil.Discard)
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	_, data := benchData(b)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := parseTree(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWalkTree(b *testing.B) {
+	t, _ := benchData(b)
+	for i := 0; i < b.N; i++ {
+		t.root.preorder()
+	}
+}
+
+func BenchmarkNextPrevItem(b *testing.B) {
+	ds := benchBuffer(b)
+	for i := 0; i < b.N; i++ {
+		ds.nextItem()
+		ds.prevItem()
+	}
+}
+
+func BenchmarkCurrentItemIndex(b *testing.B) {
+	ds := benchBuffer(b)
+	for i := 0; i < b.N; i++ {
+		ds.currentItemIndex()
+	}
+}
+
+func BenchmarkAddRemoveItem(b *testing.B) {
+	ds := benchBuffer(b)
+	for i := 0; i < b.N; i++ {
+		ds.appendItem("new")
+		ds.currentList.removeKid(ds.currentItemIndex())
+		ds.setCurrentItemUsingIndex(BENCH_LIST / 2)
+	}
+}
+
+func BenchmarkUpdateMainPane(b *testing.B) {
+	benchBuffer(b)
+	for i := 0; i < b.N; i++ {
+		updateMainPane()
+	}
+}
+
+// With cursor on an item with a large tree below it.
+func BenchmarkUpdateStatusPane(b *testing.B) {
+	ds := benchBuffer(b)
+	ds.currentList = ds.root
+	ds.setCurrentItemUsingIndex(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		updateStatusPane()
+	}
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,329 @@
+package main
+
+// Buffers: several files open at once, each with a dataStore of its own (and
+// so its own cursor, undo, dirty flag etc.). The global 'ds' is the current
+// one. Items go from one file to another by way of Target, which all buffers
+// share.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How many recently visited files to remember.
+const RECENT_FILES_MAX = 20
+
+// All open buffers, in the order they were opened.
+var buffers []*dataStore
+
+// Opens file 'path' in a new buffer, added to the list of buffers. Unless
+// 'readOnly', locks the file first: with 'ask', asking user (on the terminal,
+// as on startup) what to do if it is locked already; otherwise going on
+// read-only then. Returns nil if user chose to quit instead.
+func openBuffer(path string, readOnly, ask bool) *dataStore {
+	b := &dataStore{filename: path}
+	if len(buffers) > 0 {
+		b.Mark = buffers[0].Mark
+	}
+	switch {
+	case readOnly:
+		b.readOnly = true
+	case ask:
+		ro, err := b.lockOrAsk()
+		if err != nil {
+			return nil
+		}
+		b.readOnly = ro
+	default:
+		if o, err := b.tryLock(); o != nil {
+			Log("%q is locked by %v; opened read-only.", path, o)
+			b.readOnly = true
+		} else if err != nil {
+			Log("Unable to lock %q: %v; opened read-only.", path, err)
+			b.readOnly = true
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		b.load()
+	} else {
+		Log("Unable to stat %q; creating empty dataStore instead.", path)
+	}
+	b.init()
+	b.findJournal()
+	buffers = append(buffers, b)
+	noteRecentFile(path)
+	return b
+}
+
+// Returns index of buffer 'b' on the list of buffers.
+func bufferIndex(b *dataStore) int {
+	for i, other := range buffers {
+		if other == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns buffer of file 'path', if it is open.
+func findBuffer(path string) *dataStore {
+	abs, _ := filepath.Abs(path)
+	for _, b := range buffers {
+		if other, _ := filepath.Abs(b.filename); other == abs {
+			return b
+		}
+	}
+	return nil
+}
+
+// Returns buffer whose tree 'n' is in, if any.
+func bufferOf(n *node) *dataStore {
+	if n == nil {
+		return nil
+	}
+	root := n.ancestry()[0]
+	for _, b := range buffers {
+		if b.root == root {
+			return b
+		}
+	}
+	return nil
+}
+
+func switchBuffer(b *dataStore) {
+	ds = b
+	setTitle(filepath.Base(ds.filename))
+	Log("Switched to %q.", ds.filename)
+	cmdUnlock()
+	cmdOfferRecovery()
+}
+
+// Switches to buffer of file 'path', opening it first if need be.
+func openFile(path string) {
+	b := findBuffer(path)
+	if b == nil {
+		b = openBuffer(path, *readOnly, false)
+	}
+	switchBuffer(b)
+}
+
+// Closes current buffer, unless it has unsaved changes (or is the only one).
+func closeBuffer() {
+	if len(buffers) == 1 {
+		Log("Only buffer; quit instead.")
+		return
+	}
+	if ds.dirty && !ds.readOnly {
+		Log("%q has unsaved changes; S to save, or L to drop them, first.", ds.filename)
+		return
+	}
+	ds.removeJournal()
+	ds.releaseLock()
+	if bufferOf(ds.Mark.list) == ds {
+		ds.Mark.list = nil
+	}
+	i := bufferIndex(ds)
+	buffers = append(buffers[:i], buffers[i+1:]...)
+	switchBuffer(buffers[max(i-1, 0)])
+}
+
+// Shows open buffers. Entering one switches to it.
+func (ds *dataStore) showBuffers() {
+	items := []*node{}
+	bufferFor := make(map[*node]*dataStore)
+	for i, b := range buffers {
+		label := fmt.Sprintf("%d: %s", i+1, b.filename)
+		if b.dirty {
+			label += " *"
+		}
+		if b.readOnly {
+			label += " RO"
+		}
+		n := newNode(label)
+		items = append(items, n)
+		bufferFor[n] = b
+	}
+	ds.enterView("[buffers]", items, nil)
+	ds.currentList.view.open = func(n *node) {
+		ds.focusAscend()
+		switchBuffer(bufferFor[n])
+	}
+}
+
+////////////////////////////////////////
+// Recent files
+
+// Returns path of the file listing recently visited files.
+func recentFilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "loled", "recent")
+}
+
+// Returns recently visited files, most recent first.
+func readRecentFiles() []string {
+	data, err := ioutil.ReadFile(recentFilesPath())
+	if err != nil {
+		return []string{}
+	}
+	return strings.Fields(string(data))
+}
+
+// Puts file 'path' at the top of recently visited files.
+func noteRecentFile(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil || recentFilesPath() == "" {
+		return
+	}
+	paths := []string{abs}
+	for _, p := range readRecentFiles() {
+		if p != abs && len(paths) < RECENT_FILES_MAX {
+			paths = append(paths, p)
+		}
+	}
+	os.MkdirAll(filepath.Dir(recentFilesPath()), 0700)
+	ioutil.WriteFile(recentFilesPath(), []byte(strings.Join(paths, "\n")+"\n"), 0600)
+}
+
+// Puts the item standing in for recent files at the end of root list, unless
+// already there.
+func (ds *dataStore) ensureRecentItem() {
+	for _, n := range ds.root.sublist {
+		if n.enter != nil {
+			return
+		}
+	}
+	n := newNode(LABEL_RECENT)
+	n.enter = ds.showRecentFiles
+	ds.root.insertKid(len(ds.root.sublist), n)
+}
+
+// Shows recently visited files. Entering one opens it.
+func (ds *dataStore) showRecentFiles() {
+	items := []*node{}
+	for _, path := range readRecentFiles() {
+		items = append(items, newNode(path))
+	}
+	ds.enterView(LABEL_RECENT, items, nil)
+	ds.currentList.view.open = func(n *node) {
+		ds.focusAscend()
+		openFile(n.label)
+	}
+}
+
+////////////////////////////////////////
+// Items across files
+
+// Returns a copy of 'n' and everything below it, for another file: links to
+// items within it point to their copies, others become copies of what they
+// link to.
+func copyForTransfer(n *node) *node {
+	c := n.copyTree()
+	copies := make(map[*node]*node)
+	orig := n.preorder()
+	for i, m := range c.preorder() {
+		copies[orig[i]] = m
+	}
+	for _, m := range c.preorder() {
+		if m.link == nil {
+			continue
+		}
+		if to, ok := copies[m.link]; ok {
+			m.link = to
+		} else {
+			m.copyContent(m.link.resolve())
+		}
+	}
+	return c
+}
+
+// Returns buffer of list 'l', if that is in another file than the cursor: in
+// another buffer, or in (or out of) a file mounted. Nil if in the same file.
+func (ds *dataStore) otherFile(l *node) *dataStore {
+	b := bufferOf(l)
+	if b == nil {
+		b = ds
+	}
+	here := ds.currentList
+	if ds.currentItem != nil && ds.currentItem.parent != nil {
+		here = ds.currentItem.parent
+	}
+	if b != ds || mountOfList(l) != mountOfList(here) {
+		return b
+	}
+	return nil
+}
+
+// Returns path of the file items of list 'l' are in.
+func (ds *dataStore) fileOf(l *node) string {
+	if m := mountOfList(l); m != nil {
+		return ds.mountFile(m)
+	}
+	return ds.filename
+}
+
+// Places a copy of current item at Target 't', in another file (of buffer
+// 'b'). Returns the copy, or nil if none was placed.
+func (ds *dataStore) copyToBuffer(b *dataStore, t *Target) *node {
+	if ds.currentItem == nil {
+		Log("No current item.")
+		return nil
+	}
+	if ds.currentItem.enter != nil {
+		Log("Not an item of the tree.")
+		return nil
+	}
+	if b.readOnly {
+		Log("%q is read-only.", b.filename)
+		return nil
+	}
+	c := copyForTransfer(ds.currentItem)
+	t.insert(c)
+	b.forgetUndo()
+	b.dirty = true
+	return c
+}
+
+// Moves current item to Target 't', in another file (of buffer 'b'). What
+// gets there is a copy, while the item itself goes to Trash of its own file,
+// as there may be links to it left.
+func (ds *dataStore) moveToBuffer(b *dataStore, t *Target) {
+	c := ds.copyToBuffer(b, t)
+	if c == nil {
+		return
+	}
+	_, trash := ds.fileLists(ds.currentItem.parent)
+	ds.MoveCurrentItemToTarget(trash)
+	Log("Moved %q to %q; original is in Trash.", c.label, b.fileOf(t.list))
+}
+
+// Takes the item at Target 't', in another file (of buffer 'b'), inserting a
+// copy of it at the cursor; the item itself goes to Trash there.
+func (ds *dataStore) pullFromBuffer(b *dataStore, t *Target) {
+	if b.readOnly {
+		Log("%q is read-only.", b.filename)
+		return
+	}
+	n := t.list.sublist[t.itemIndex()]
+	c := copyForTransfer(n)
+	_, trash := b.fileLists(n.parent)
+	t.take()
+	trash.insert(n)
+	b.forgetUndo()
+	b.dirty = true
+
+	i := max(ds.currentItemIndex(), 0)
+	ds.currentList.insertKid(i, c)
+	ds.setCurrentItemUsingIndex(i)
+	ds.forgetUndo()
+	ds.dirty = true
+	Log("Pulled %q from %q; original is in Trash there.", c.label, b.fileOf(t.list))
+}
+
+// vim: fdm=syntax
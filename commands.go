@@ -1,19 +1,49 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
 	"strings"
+
+	"github.com/jroimartin/gocui"
 )
 
 ////////////////////////////////////////
 // COMMANDS
 
+// Whether current list is part of the tree, so that items can be put on it
+// or taken off it. Lets user know, if not.
+func requireTreeList() bool {
+	if ds.currentList.view != nil {
+		Log("Not possible in %s.", ds.currentList.label)
+		return false
+	}
+	return true
+}
+
+// Whether tree may be changed. Lets user know, if not.
+func requireWritable() bool {
+	if ds.sealed != nil {
+		Log("Encrypted; L to enter passphrase.")
+		return false
+	}
+	if ds.readOnly {
+		Log("Read-only; R to allow changes.")
+		return false
+	}
+	return true
+}
+
 func cmdAddItems() {
+	if !requireTreeList() {
+		return
+	}
 	dlgEditor := dialog(vd.gui, "Add", "", true)
 	dlgEditor.onFinish = func(ss []string) {
 		for _, s := range ss {
 			text := strings.TrimRight(s, whitespace)
 			if len(text) > 0 {
-				ds.appendItem(text)
+				ds.appendItem(text).takeDateTokens(today())
 			}
 		}
 		updateMainPane()
@@ -24,16 +54,180 @@ func cmdReplaceItem() {
 	if ds.currentItem == nil {
 		return
 	}
-	dlgEditor := dialog(vd.gui, "Replace", ds.currentItem.label, false)
+	dlgEditor := dialog(vd.gui, "Replace", ds.currentItem.resolve().label, false)
 	dlgEditor.onFinish = func(ss []string) {
 		ds.replaceItem(ss[0])
+		ds.currentItem.resolve().takeDateTokens(today())
+		updateMainPane()
+	}
+}
+
+func cmdEditNote() {
+	if ds.currentItem == nil {
+		return
+	}
+	dlgEditor := textDialog(vd.gui, "Note (Ctrl-S when done)", ds.currentItem.resolve().note)
+	dlgEditor.onFinish = func(ss []string) {
+		ds.setNote(strings.TrimRight(strings.Join(ss, "\n"), whitespace))
+		updateMainPane()
+	}
+}
+
+// Edits query of current smart list item, or adds a new smart list.
+func cmdEditQuery() {
+	if !requireTreeList() {
+		return
+	}
+	query := ""
+	if ds.currentItem != nil {
+		query = ds.currentItem.resolve().query
+	}
+	dlgEditor := dialog(vd.gui, "Smart list query (#tag due:..+7d under:x done:no)",
+		query, false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 {
+			ss = []string{""}
+		}
+		ds.setQuery(ss[0])
+		updateMainPane()
+	}
+}
+
+// Shows saved versions of the file, to preview or restore.
+func cmdShowHistory() {
+	ds.showHistory()
+	updateMainPane()
+}
+
+// Copies a reference to current item, for pasting into labels.
+func cmdCopyRef() {
+	if ds.currentItem == nil {
+		return
+	}
+	vd.clipboard = refTo(ds.currentItem.resolve())
+	Log("Copied %s; paste with Ctrl-Y.", vd.clipboard)
+	updateMainPane()
+}
+
+func cmdFollowRef(nth int) {
+	ds.followRef(nth)
+	updateMainPane()
+}
+
+func cmdShowBacklinks() {
+	ds.showBacklinks()
+	updateMainPane()
+}
+
+func cmdEditDates() {
+	if ds.currentItem == nil {
+		return
+	}
+	dlgEditor := dialog(vd.gui, "Dates (fri, +3d, sched:mon, repeat:)",
+		formatDateTokens(ds.currentItem.resolve()), false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 {
+			ss = []string{""}
+		}
+		ds.setDates(ss[0])
+		updateMainPane()
+	}
+}
+
+func cmdSetPriority(p int) {
+	ds.setPriority(p)
+	updateMainPane()
+}
+
+func cmdFilterByPriority(p int) {
+	ds.filterByPriority(p)
+	updateMainPane()
+}
+
+func cmdShowTopPriorities(p int) {
+	ds.showTopPriorities(p)
+	updateMainPane()
+}
+
+func cmdEditTags() {
+	if ds.currentItem == nil {
+		return
+	}
+	dlgEditor := dialog(vd.gui, "Tags (e.g. #work @home)",
+		strings.Join(ds.currentItem.resolve().tags(), " "), false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 {
+			ss = []string{""}
+		}
+		ds.setTags(ss[0])
+		updateMainPane()
+	}
+}
+
+func cmdShowTags() {
+	ds.showTags()
+	updateMainPane()
+}
+
+func cmdShowAgenda() {
+	ds.showAgenda()
+	updateMainPane()
+}
+
+func cmdSearch() {
+	dlgEditor := dialog(vd.gui, "Search", ds.lastSearch, false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 || ss[0] == "" {
+			return
+		}
+		ds.lastSearch = ss[0]
+		ds.searchNext(ds.lastSearch)
 		updateMainPane()
 	}
 }
 
-func cmdToggleItem() {
-	ds.toggleItem()
-	cmdNextItem()
+func cmdSearchNext() {
+	if ds.lastSearch == "" {
+		Log("No previous search.")
+		return
+	}
+	ds.searchNext(ds.lastSearch)
+	updateMainPane()
+}
+
+// Edits current item and everything below it, or with 'wholeList' all of the
+// current list, as indented text in $EDITOR.
+func cmdEditInEditor(wholeList bool) {
+	if !requireTreeList() {
+		return
+	}
+	parent := ds.currentList
+	var pos int
+	var old []*node
+	if wholeList {
+		old = append(old, parent.sublist...)
+	} else {
+		if ds.currentItem == nil {
+			return
+		}
+		pos = ds.currentItemIndex()
+		old = []*node{ds.currentItem}
+	}
+	suspendGui(func() {
+		items, err := editOutline(old)
+		if err != nil {
+			Log("Edit failed: %v", err)
+			return
+		}
+		ds.replaceWithOutline(parent, pos, old, items)
+	})
+}
+
+func cmdToggleItem(count int) {
+	for i := 0; i < count; i++ {
+		ds.toggleItem()
+		ds.nextItem()
+	}
 	updateMainPane()
 }
 
@@ -43,6 +237,9 @@ func cmdToggleAllItems() {
 }
 
 func cmdFoldItems() {
+	if !requireTreeList() {
+		return
+	}
 	dlgEditor := dialog(vd.gui, "Fold", "", false)
 	dlgEditor.onFinish = func(ss []string) {
 		ds.foldTaggedItemsUnder(ss[0])
@@ -51,17 +248,82 @@ func cmdFoldItems() {
 }
 
 func cmdUnfoldItems() {
+	if !requireTreeList() {
+		return
+	}
 	ds.unfoldItems()
 	updateMainPane()
 }
 
-func cmdNextItem() {
-	ds.nextItem()
+func cmdSortItems() {
+	if !requireTreeList() {
+		return
+	}
+	dlgEditor := dialog(vd.gui, "Sort: a/n/c/p/d, r=rev, R=deep", "n", false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 {
+			return
+		}
+		var less itemLess = byLabel
+		reverse, recursive := false, false
+		for _, c := range strings.Trim(ss[0], whitespace) {
+			switch c {
+			case 'a':
+				less = byLabel
+			case 'n':
+				less = byLabelNatural
+			case 'c':
+				less = byKidCount
+			case 'p':
+				less = byPriority
+			case 'd':
+				less = byDate
+			case 'r':
+				reverse = true
+			case 'R':
+				recursive = true
+			default:
+				Log("Unknown sort option %q.", c)
+				return
+			}
+		}
+		ds.sortItems(less, reverse, recursive)
+		updateMainPane()
+	}
+}
+
+func cmdDedupeItems() {
+	if !requireTreeList() {
+		return
+	}
+	ds.dedupeItems()
+	updateMainPane()
+}
+
+func cmdShuffleItems() {
+	if !requireTreeList() {
+		return
+	}
+	ds.shuffleItems()
 	updateMainPane()
 }
 
-func cmdPrevItem() {
-	ds.prevItem()
+func cmdUndo() {
+	ds.Undo()
+	updateMainPane()
+}
+
+func cmdNextItem(count int) {
+	for i := 0; i < count; i++ {
+		ds.nextItem()
+	}
+	updateMainPane()
+}
+
+func cmdPrevItem(count int) {
+	for i := 0; i < count; i++ {
+		ds.prevItem()
+	}
 	updateMainPane()
 }
 
@@ -75,6 +337,25 @@ func cmdLastItem() {
 	updateMainPane()
 }
 
+func cmdJumpToItem(idx int) {
+	ds.nthItem(idx)
+	updateMainPane()
+}
+
+func cmdCycleGutter() {
+	le := vd.editorLol
+	le.gutter = (le.gutter + 1) % 3
+	switch le.gutter {
+	case GUTTER_NONE:
+		Log("Item numbers off.")
+	case GUTTER_NUMBERS:
+		Log("Item numbers on.")
+	case GUTTER_DIGIT_JUMP:
+		Log("Digit jump on (lists of up to %d items).", DIGIT_JUMP_MAX_ITEMS)
+	}
+	updateMainPane()
+}
+
 func cmdDescend() {
 	ds.focusDescend()
 	updateMainPane()
@@ -85,37 +366,275 @@ func cmdAscend() {
 	updateMainPane()
 }
 
+func cmdJumpToAncestor(depth int) {
+	ds.focusAncestor(depth)
+	updateMainPane()
+}
+
 func cmdSaveData() {
+	if !requireWritable() {
+		return
+	}
+	if ds.changedOnDisk() {
+		cmdResolveDiskChange()
+		return
+	}
 	ds.save()
 	updateMainPane()
 }
 
 func cmdLoadData() {
+	if ds.dirty && ds.changedOnDisk() {
+		cmdResolveDiskChange()
+		return
+	}
 	ds.load()
+	cmdUnlock()
+	updateMainPane()
+}
+
+// Asks for the passphrase of current buffer's file, if found encrypted and
+// not unlocked yet. Deferred, so as not to clash with a dialog just being
+// finished.
+func cmdUnlock() {
+	b := ds
+	if b.sealed == nil || vd.gui == nil {
+		return
+	}
+	vd.gui.Update(func(g *gocui.Gui) error {
+		if b.sealed == nil || b != ds {
+			return nil
+		}
+		dlgEditor := secretDialog(g, "Passphrase for "+filepath.Base(b.filename))
+		if dlgEditor == nil {
+			return nil
+		}
+		dlgEditor.onFinish = func(ss []string) {
+			if ss[0] == "" {
+				Log("Not unlocked; L to enter passphrase.")
+				return
+			}
+			if err := b.unlock(ss[0]); err == errWrongPassphrase {
+				Log("Wrong passphrase.")
+				cmdUnlock()
+			} else if err != nil {
+				Log("Not unlocked: %v.", err)
+			} else {
+				cmdOfferRecovery()
+			}
+			updateMainPane()
+		}
+		return nil
+	})
+}
+
+// Asks user what to do about unsaved changes to current buffer's file left
+// over from before (a crash, say), if any and not asked yet. Deferred, as is
+// cmdUnlock().
+func cmdOfferRecovery() {
+	b := ds
+	if b.journal.found.IsZero() || b.journal.asked || b.sealed != nil || vd.gui == nil {
+		return
+	}
+	vd.gui.Update(func(g *gocui.Gui) error {
+		if b != ds {
+			return nil
+		}
+		title := fmt.Sprintf("Unsaved changes from %s: r=recover d=discard k=keep",
+			b.journal.found.Format(HISTORY_TIME_FORMAT))
+		dlgEditor := dialog(g, title, "", false)
+		if dlgEditor == nil {
+			return nil
+		}
+		b.journal.asked = true
+		dlgEditor.onFinish = func(ss []string) {
+			answer := ""
+			if len(ss) > 0 {
+				answer = strings.ToLower(strings.TrimSpace(ss[0]))
+			}
+			switch answer {
+			case "r":
+				if err := b.recoverJournal(); err != nil {
+					Log("Unable to recover: %v.", err)
+				}
+			case "d":
+				b.discardJournal()
+				Log("Discarded.")
+			default:
+				Log("Kept in %q; no journal kept of changes meanwhile.", b.journalPath())
+			}
+			updateMainPane()
+		}
+		return nil
+	})
+}
+
+// Sets (or changes, or removes) the passphrase the file is encrypted with,
+// asking for it twice.
+func cmdSetPassphrase() {
+	dlgEditor := secretDialog(vd.gui, "New passphrase (empty: unencrypted)")
+	dlgEditor.onFinish = func(first []string) {
+		vd.gui.Update(func(g *gocui.Gui) error {
+			dlgEditor := secretDialog(g, "Passphrase again")
+			if dlgEditor == nil {
+				return nil
+			}
+			dlgEditor.onFinish = func(again []string) {
+				if again[0] != first[0] {
+					Log("Passphrases differ; nothing changed.")
+					return
+				}
+				if err := ds.setPassphrase(first[0]); err != nil {
+					Log("Passphrase not set: %v.", err)
+				}
+				updateMainPane()
+			}
+			return nil
+		})
+	}
+}
+
+// Asks user what to do about file having changed on disk.
+func cmdResolveDiskChange() {
+	dlgEditor := dialog(vd.gui, "Changed on disk: r=reload k=keep yours m=merge", "", false)
+	dlgEditor.onFinish = func(ss []string) {
+		answer := ""
+		if len(ss) > 0 {
+			answer = strings.ToLower(strings.TrimSpace(ss[0]))
+		}
+		switch answer {
+		case "r":
+			ds.load()
+		case "k":
+			ds.save()
+		case "m":
+			ds.mergeFromDisk()
+		default:
+			Log("Nothing done; %q still differs.", ds.filename)
+		}
+		updateMainPane()
+	}
+}
+
+// Switches to buffer 'n' (from 1), or with 'n' 0, shows buffers to pick from.
+func cmdSwitchBuffer(n int) {
+	switch {
+	case n == 0:
+		ds.showBuffers()
+	case n > len(buffers):
+		Log("Only %d buffer(s).", len(buffers))
+	default:
+		switchBuffer(buffers[n-1])
+	}
+	updateMainPane()
+}
+
+func cmdOpenFile() {
+	dlgEditor := dialog(vd.gui, "Open file", filepath.Dir(ds.filename)+"/", false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 || strings.TrimSpace(ss[0]) == "" {
+			return
+		}
+		openFile(strings.TrimSpace(ss[0]))
+		updateMainPane()
+	}
+}
+
+func cmdMountFile() {
+	if !requireTreeList() {
+		return
+	}
+	dlgEditor := dialog(vd.gui, "Mount file (relative to this one's)", "", false)
+	dlgEditor.onFinish = func(ss []string) {
+		if len(ss) == 0 || strings.TrimSpace(ss[0]) == "" {
+			return
+		}
+		ds.appendMount(strings.TrimSpace(ss[0]))
+		updateMainPane()
+	}
+}
+
+func cmdCloseBuffer() {
+	closeBuffer()
+	updateMainPane()
+}
+
+func cmdToggleReadOnly() {
+	ds.toggleReadOnly()
 	updateMainPane()
 }
 
 func cmdSetUserTarget() {
+	if !requireTreeList() {
+		return
+	}
 	ds.SetUserTarget()
 	// No need to update pane.
 }
 
-func cmdMoveCurrentItemToTarget(t *Target) {
-	ds.MoveCurrentItemToTarget(t)
+// Moves 'count' consecutive items, starting with the current one.
+func cmdMoveCurrentItemToTarget(t *Target, count int) {
+	if v := ds.currentList.view; v != nil && v.readOnly {
+		// Items of an old version cannot move, but copies of them can.
+		ds.restoreToTarget(t)
+		updateMainPane()
+		return
+	}
+	for i := 0; i < count && ds.currentItem != nil; i++ {
+		ds.MoveCurrentItemToTarget(t)
+	}
+	updateMainPane()
+}
+
+func cmdLinkCurrentItemAtTarget(t *Target) {
+	ds.LinkCurrentItemAtTarget(t)
 	updateMainPane()
 }
 
-func cmdMoveToDone() {
-	ds.MoveCurrentItemToTarget(ds.markDone)
+func cmdMoveToDone(count int) {
+	for i := 0; i < count && ds.currentItem != nil; i++ {
+		// Stop at the next occurrence of a recurring item, if that is
+		// where the cursor landed.
+		if next := ds.completeCurrentItem(); next != nil && next == ds.currentItem {
+			break
+		}
+	}
 	updateMainPane()
 }
 
-func cmdMoveToTrash() {
-	ds.MoveCurrentItemToTarget(ds.markTrash)
+func cmdMoveToTrash(count int) {
+	_, trash := ds.fileLists(ds.currentList)
+	cmdMoveCurrentItemToTarget(trash, count)
+}
+
+// Pulls up to 'count' items from Target; the last one pulled ends up first.
+func cmdPullFromTarget(t *Target, count int) {
+	if !requireTreeList() {
+		return
+	}
+	for i := 0; i < count; i++ {
+		ds.PullItemFromTarget(t)
+		if t.list == nil || t.itemIndex() < 0 {
+			break
+		}
+	}
 	updateMainPane()
 }
 
+func cmdReopenFromDone(count int) {
+	done, _ := ds.fileLists(ds.currentList)
+	cmdPullFromTarget(done, count)
+}
+
+func cmdRestoreFromTrash(count int) {
+	_, trash := ds.fileLists(ds.currentList)
+	cmdPullFromTarget(trash, count)
+}
+
 func cmdGoToUserTarget() {
+	if b := bufferOf(ds.Mark.list); b != nil && b != ds {
+		switchBuffer(b)
+	}
 	ds.GoToUserTarget()
 	updateMainPane()
 }
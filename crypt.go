@@ -0,0 +1,201 @@
+package main
+
+// Encrypted list files: the file as it would otherwise be saved, sealed with
+// AES-256-GCM under a key derived from a passphrase by argon2id. Such a file
+// is a header line, saying how the key is derived, followed by the nonce and
+// the ciphertext:
+//
+//	LOLCRYPT 1 argon2id t=3 m=65536 p=4 SALT
+//	NONCE CIPHERTEXT...
+//
+// (the latter two in binary). The header is authenticated along with the
+// contents, so that neither can be changed unnoticed.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const CRYPT_MAGIC = "LOLCRYPT"
+
+// Key derivation cost: passes, memory (KiB) and threads; see argon2.IDKey.
+const (
+	CRYPT_TIME    = 3
+	CRYPT_MEMORY  = 64 * 1024
+	CRYPT_THREADS = 4
+)
+
+// Most a file may ask of key derivation, so that a damaged header cannot
+// have it take forever or all memory.
+const (
+	CRYPT_TIME_MAX    = 16
+	CRYPT_MEMORY_MAX  = 1024 * 1024
+	CRYPT_THREADS_MAX = 64
+)
+
+var errNoPassphrase = errors.New("encrypted, and no passphrase given")
+var errWrongPassphrase = errors.New("wrong passphrase, or file damaged")
+
+// A key derived from a passphrase, along with how.
+type cryptKey struct {
+	// Kept to derive keys for files saved with another salt (e.g., by
+	// another loled) without asking again.
+	passphrase string
+	// Header line of files sealed with this key, sans newline.
+	header string
+	key    []byte
+}
+
+// Whether file contents 'data' are encrypted.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(CRYPT_MAGIC+" "))
+}
+
+// Derives a key from 'passphrase' as header line 'header' says.
+func deriveCryptKey(passphrase, header string) (*cryptKey, error) {
+	var version, time, memory, threads int
+	var kdf, salt64 string
+	_, err := fmt.Sscanf(header, CRYPT_MAGIC+" %d %s t=%d m=%d p=%d %s",
+		&version, &kdf, &time, &memory, &threads, &salt64)
+	if err != nil || version != 1 || kdf != "argon2id" {
+		return nil, fmt.Errorf("unknown encryption %q", header)
+	}
+	if time < 1 || time > CRYPT_TIME_MAX || threads < 1 || threads > CRYPT_THREADS_MAX ||
+		memory < 8*threads || memory > CRYPT_MEMORY_MAX {
+		return nil, fmt.Errorf("bad key derivation cost in %q", header)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(salt64)
+	if err != nil || len(salt) < 8 {
+		return nil, fmt.Errorf("bad salt in %q", header)
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, uint32(time), uint32(memory), uint8(threads), 32)
+	return &cryptKey{passphrase, header, key}, nil
+}
+
+// Derives a key from 'passphrase', with a fresh salt, for files to be
+// encrypted from now on.
+func newCryptKey(passphrase string) (*cryptKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s 1 argon2id t=%d m=%d p=%d %s", CRYPT_MAGIC,
+		CRYPT_TIME, CRYPT_MEMORY, CRYPT_THREADS, base64.RawStdEncoding.EncodeToString(salt))
+	return deriveCryptKey(passphrase, header)
+}
+
+// Returns the key for encrypted file contents 'data': this one, if they were
+// sealed with it, else one derived anew from the same passphrase.
+func (k *cryptKey) forData(data []byte) (*cryptKey, error) {
+	header := strings.SplitN(string(data), "\n", 2)[0]
+	if header == k.header {
+		return k, nil
+	}
+	return deriveCryptKey(k.passphrase, header)
+}
+
+func (k *cryptKey) aead() cipher.AEAD {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// Returns 'plain' encrypted, as file contents.
+func (k *cryptKey) seal(plain []byte) ([]byte, error) {
+	aead := k.aead()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data := []byte(k.header + "\n")
+	data = append(data, nonce...)
+	return aead.Seal(data, nonce, plain, []byte(k.header)), nil
+}
+
+// Reverse of seal().
+func (k *cryptKey) open(data []byte) ([]byte, error) {
+	aead := k.aead()
+	parts := bytes.SplitN(data, []byte("\n"), 2)
+	if len(parts) != 2 || string(parts[0]) != k.header || len(parts[1]) < aead.NonceSize() {
+		return nil, errWrongPassphrase
+	}
+	nonce, sealed := parts[1][:aead.NonceSize()], parts[1][aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, parts[0])
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plain, nil
+}
+
+// Returns file contents 'data' decrypted, if encrypted; errNoPassphrase if no
+// passphrase is known yet.
+func (ds *dataStore) decrypt(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	if ds.crypt == nil {
+		return nil, errNoPassphrase
+	}
+	k, err := ds.crypt.forData(data)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := k.open(data)
+	if err != nil {
+		return nil, err
+	}
+	ds.crypt = k
+	return plain, nil
+}
+
+// Tries 'passphrase' on the file found encrypted by load(); loads it if
+// right.
+func (ds *dataStore) unlock(passphrase string) error {
+	header := strings.SplitN(string(ds.sealed), "\n", 2)[0]
+	k, err := deriveCryptKey(passphrase, header)
+	if err != nil {
+		return err
+	}
+	if _, err := k.open(ds.sealed); err != nil {
+		return err
+	}
+	ds.crypt = k
+	ds.sealed = nil
+	ds.load()
+	return nil
+}
+
+// Sets passphrase to encrypt file with from now on; empty to no longer
+// encrypt it.
+func (ds *dataStore) setPassphrase(passphrase string) error {
+	if passphrase == "" {
+		ds.crypt = nil
+		ds.dirty = true
+		Log("Will be saved unencrypted; S to save.")
+		return nil
+	}
+	k, err := newCryptKey(passphrase)
+	if err != nil {
+		return err
+	}
+	ds.crypt = k
+	ds.dirty = true
+	Log("Will be saved encrypted; S to save.")
+	return nil
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Salt, base64, for headers made up here.
+const testSalt = "c2FsdHNhbHRzYWx0"
+
+func TestSealOpen(t *testing.T) {
+	k, err := newCryptKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("node 1\nroot\n\n")
+	data, err := k.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(data) || bytes.Contains(data, plain) {
+		t.Fatalf("not encrypted: %q", data)
+	}
+
+	// Opened with a key derived anew, as on loading.
+	same, err := (&cryptKey{passphrase: "secret"}).forData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := same.open(data); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("open: %q, %v", got, err)
+	}
+
+	wrong, err := (&cryptKey{passphrase: "wrong"}).forData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.open(data); err != errWrongPassphrase {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+
+	damaged := append([]byte{}, data...)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := k.open(damaged); err != errWrongPassphrase {
+		t.Errorf("damaged: %v", err)
+	}
+	if _, err := k.open(data[:len(k.header)+1]); err != errWrongPassphrase {
+		t.Errorf("cut short: %v", err)
+	}
+}
+
+func TestDeriveCryptKey(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"LOLCRYPT 1 argon2id t=1 m=64 p=1 " + testSalt, true},
+		{"LOLCRYPT 1 argon2id t=16 m=512 p=64 " + testSalt, true},
+		{"LOLCRYPT 2 argon2id t=1 m=64 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 scrypt t=1 m=64 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=0 m=64 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=17 m=64 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=1 m=64 p=0 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=1 m=1024 p=65 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=1 m=7 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=1 m=1048577 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=1 m=-64 p=1 " + testSalt, false},
+		{"LOLCRYPT 1 argon2id t=1 m=64 p=1 c2FsdA", false},
+		{"LOLCRYPT 1 argon2id t=1 m=64 p=1 !!!", false},
+		{"LOLCRYPT 1 argon2id t=1 m=64 p=1", false},
+	}
+	for _, tt := range tests {
+		_, err := deriveCryptKey("secret", tt.header)
+		if (err == nil) != tt.ok {
+			t.Errorf("deriveCryptKey(%q): %v", tt.header, err)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // A "pointer" into the mass structure of list-of-lists. Identifies an item
@@ -20,8 +25,79 @@ type Target struct {
 	before bool
 }
 
+// Places 'n' into the Target's list, at the Target's position.
+func (t *Target) insert(n *node) {
+	kids := &t.list.sublist
+	if len(*kids) == 0 {
+		*kids = []*node{n}
+	} else {
+		*kids = append(*kids, nil) // extend length by 1
+		i := t.index
+		if !t.before {
+			i += 1
+		}
+		// There is a second part to shift only if item to insert is
+		// not meant as last item.
+		if i < len(*kids)-1 {
+			copy((*kids)[i+1:], (*kids)[i:])
+		}
+		if i > len(*kids)-1 {
+			Log("WARNING: Target pointing beyond list (idx=%v vs maxidx=%v).",
+				i, len(*kids)-1)
+			i = len(*kids) - 1
+		}
+		(*kids)[i] = n
+	}
+	n.parent = t.list
+	touchMount(t.list)
+	indexFor(t.list).addTree(n)
+
+	// Maybe advance Target index, depending on type of Target. Behaviour
+	// is determined by what the end effect is of moving multiple items
+	// using these Targets:
+	// "Before" Targets: desired effect = reverse chronological addition
+	// "After" Targets: desired effect = chronological addition
+	if !t.before {
+		t.index += 1
+	}
+}
+
+// Returns index of the item a take() would remove, or -1 if there is none.
+func (t *Target) itemIndex() int {
+	if t.list == nil || len(t.list.sublist) == 0 {
+		return -1
+	}
+	kids := t.list.sublist
+	i := max(t.index, 0)
+	if i > len(kids)-1 {
+		Log("WARNING: Target pointing beyond list (idx=%v vs maxidx=%v).",
+			i, len(kids)-1)
+		i = len(kids) - 1
+	}
+	return i
+}
+
+// The reverse of insert(): removes and returns the item at the Target's
+// position, or nil if there is none. For both kinds of Target that is the
+// item most recently inserted there, so an "After" Target steps back to
+// keep pointing at the item before it.
+func (t *Target) take() *node {
+	i := t.itemIndex()
+	if i < 0 {
+		return nil
+	}
+	n := t.list.removeKid(i)
+	if !t.before && t.index >= 0 {
+		t.index = i - 1
+	}
+	return n
+}
+
 // The "Model" component of MVC framework.
 type dataStore struct {
+	// File the tree is saved to and loaded from.
+	filename string
+
 	// Root node
 	root *node
 
@@ -32,20 +108,58 @@ type dataStore struct {
 	// TODO: this too should be a Target (and probably name 'cursor').
 	currentList *node
 	currentItem *node
+	// Index of currentItem on currentList, as last set. Only a hint, to be
+	// checked before use: currentItem is at times set directly, and lists
+	// change.
+	currentIndex int
 
 	// Indicates if data has been modified, and needs to be saved.
 	dirty bool
 
-	// User-defined targets.
+	// User-defined targets. Shared by all buffers, so that items can be
+	// moved from one file to another.
 	//
 	// NOTE: in future we will have multiple; these will be like  "marks"
 	// in Vim.
-	Mark Target
+	Mark *Target
 
 	// Pre-defined special targets.
 	// NOTE: using * so that able to differentiate uninitialized Target.
 	markTrash *Target // Where deleted items are moved.
 	markDone  *Target // Where DONE items are moved.
+
+	// Operations that can be undone, most recent last.
+	undo []undoStep
+
+	// Most recent search string, for repeating the search.
+	lastSearch string
+
+	// Links descended through, most recent last; ascending out of what a
+	// link shows returns to the link.
+	linkTrail []*node
+
+	// Highest node id saved in the file so far; see fileTree.
+	lastId int
+
+	// The file as last loaded or saved, to tell changes made to it by
+	// others.
+	disk diskState
+
+	// Whether the tree may not be changed or saved, e.g. as the file is
+	// locked by someone else.
+	readOnly bool
+
+	// Set if the file is (to be) saved encrypted; see crypt.go.
+	crypt *cryptKey
+	// Contents of the file, if found encrypted on loading and not yet
+	// decrypted (for want of the passphrase). Not saved over meanwhile.
+	sealed []byte
+
+	// Unsaved changes kept for crash recovery; see journal.go.
+	journal journalState
+
+	// Of the tree; see index.go. Nil until needed.
+	index *treeIndex
 }
 
 // (Finish) initializing data store.
@@ -56,16 +170,32 @@ type dataStore struct {
 func (ds *dataStore) init() {
 	ds.dirty = false
 
+	if ds.Mark == nil {
+		ds.Mark = &Target{}
+	}
+
 	// This runs only on startup; 'load' will have populated this.
 	if ds.root == nil {
-		ds.root = &node{
-			"root",
-			nil, // parent pointer (i.e., none)
-			make([]*node, 0),
-			false, // tagged
-		}
+		ds.root = newNode("root")
+		ds.root.id = ROOT_ID
+	}
+
+	rootkids := ds.root.sublist
+	ds.ensureFileLists()
+	ds.ensureRecentItem()
+
+	// Reset cursor.
+	ds.currentList = ds.root
+	if len(rootkids) > 0 {
+		ds.currentItem = rootkids[0]
+	} else {
+		// invalid == no current item
+		ds.currentItem = nil
 	}
+}
 
+// Adds DONE and Trash lists to the tree, unless there already.
+func (ds *dataStore) ensureFileLists() {
 	// Set temporarily, for potential insertions.
 	ds.currentList = ds.root
 	rootkids := ds.root.sublist
@@ -93,15 +223,6 @@ func (ds *dataStore) init() {
 		n := ds.appendItem(LABEL_TRASH)
 		ds.markTrash = &Target{n, 0, true} // always just before first item
 	}
-
-	// Reset cursor.
-	ds.currentList = ds.root
-	if len(rootkids) > 0 {
-		ds.currentItem = rootkids[0]
-	} else {
-		// invalid == no current item
-		ds.currentItem = nil
-	}
 }
 
 // Sets current item and updates the UI selection bar to it.
@@ -132,9 +253,11 @@ func (ds *dataStore) setCurrentItemUsingIndex(idx int) {
 	}
 
 	ds.currentItem = items[idx]
+	ds.currentIndex = idx
 	if vd.paneMain != nil {
-		// +2 offset due to list title and underline.
-		vd.paneMain.SetCursor(0, idx+2)
+		// +2 offset due to list title and underline. Off the pane, if the
+		// list is to scroll; updateMainPane() sees to that.
+		vd.paneMain.SetCursor(0, idx-vd.mainFirst+2)
 		vd.paneMain.Highlight = true
 	}
 }
@@ -149,6 +272,10 @@ func (ds *dataStore) indexOfItem(n *node) int {
 		Log("indexOfItem(%v) called but current list has no sublist.", n)
 		return -1
 	}
+	if i := ds.currentIndex; i >= 0 && i < len(l.sublist) && l.sublist[i] == n {
+		// Usually the current item, and still where it was.
+		return i
+	}
 	for i, k := range ds.currentList.sublist {
 		if k == n {
 			return i
@@ -164,10 +291,9 @@ func (ds *dataStore) currentItemIndex() int {
 		return -1
 	}
 
-	for i, k := range ds.currentList.sublist {
-		if k == ds.currentItem {
-			return i
-		}
+	if i := ds.indexOfItem(ds.currentItem); i >= 0 {
+		ds.currentIndex = i
+		return i
 	}
 
 	panic("Current item not on current list.")
@@ -175,21 +301,17 @@ func (ds *dataStore) currentItemIndex() int {
 
 // Returns the created node.
 func (ds *dataStore) appendItem(s string) *node {
-	n := node{
-		s,                // payload
-		ds.currentList,   // parent
-		make([]*node, 0), // sublist
-		false,            // tagged
-	}
+	n := newNode(s)
 	i := ds.currentItemIndex()
-	ds.currentList.insertKid(i+1, &n)
+	ds.currentList.insertKid(i+1, n)
 
 	// Make the latest node the current one.
 	ds.setCurrentItemUsingIndex(i + 1)
 
+	ds.forgetUndo()
 	ds.dirty = true
 
-	return &n
+	return n
 }
 
 // Replace the current item's label with the provided string.
@@ -198,8 +320,9 @@ func (ds *dataStore) replaceItem(s string) {
 		// No current item.
 		return
 	}
-	ds.currentItem.label = s
-	ds.dirty = true
+	n := ds.currentItem.resolve()
+	changeItem(n, func() { n.label = s })
+	ds.changedList(n.parent)
 }
 
 func (ds *dataStore) toggleItem() {
@@ -251,9 +374,17 @@ func (ds *dataStore) GoToUserTarget() {
 	Log("Jumped to Target.")
 }
 
+// Empties Trash of the file the cursor is in (a file mounted, maybe).
 func (ds *dataStore) ExpungeTrash() {
-	if len(ds.markTrash.list.sublist) > 0 {
-		ds.markTrash.list.sublist = ds.markTrash.list.sublist[0:0]
+	root, trash := ds.root, ds.markTrash
+	if m := mountOfList(ds.currentList); m != nil && m.mount.loaded {
+		root, trash = m, m.mount.trash
+	}
+	if len(trash.list.sublist) > 0 {
+		ds.promoteLinks(root, trash.list)
+		trash.list.sublist = trash.list.sublist[0:0]
+		ds.reindex()
+		ds.forgetUndo()
 		ds.dirty = true
 	}
 }
@@ -267,8 +398,23 @@ func (ds *dataStore) MoveCurrentItemToTarget(t *Target) {
 		return
 	}
 
-	// First, remove item from current list.
+	if ds.currentItem.parent == nil || ds.currentItem.enter != nil {
+		Log("Not an item of the tree.")
+		return
+	}
+
+	if b := ds.otherFile(t.list); b != nil {
+		ds.moveToBuffer(b, t)
+		return
+	}
+
+	// First, remove item from current list. In a view, that is not the
+	// list the item is really on, so take it off of that one too.
 	i := ds.currentItemIndex()
+	if ds.currentList.view != nil {
+		p := ds.currentItem.parent
+		p.removeKid(p.indexOf(ds.currentItem))
+	}
 	ds.currentList.removeKid(i)
 	kids := &ds.currentList.sublist
 
@@ -285,41 +431,59 @@ func (ds *dataStore) MoveCurrentItemToTarget(t *Target) {
 	}
 
 	// Now place it at Target
-	kids = &t.list.sublist
-	if len(*kids) == 0 {
-		*kids = []*node{ds.currentItem}
-	} else {
-		*kids = append(*kids, nil) // extend length by 1
-		i = t.index
-		if !t.before {
-			i += 1
-		}
-		// There is a second part to shift only if item to insert is
-		// not meant as last item.
-		if i < len(*kids)-1 {
-			copy((*kids)[i+1:], (*kids)[i:])
-		}
-		if i > len(*kids)-1 {
-			Log("WARNING: Target pointing beyond list (idx=%v vs maxidx=%v).",
-				i, len(*kids)-1)
-			i = len(*kids) - 1
+	t.insert(ds.currentItem)
+
+	// Finally make sure current item is its former successor.
+	ds.currentItem = newCurrentItem
+
+	ds.forgetUndo()
+	ds.dirty = true
+}
+
+// Reverse of MoveCurrentItemToTarget(): takes the item at Target 't' and
+// inserts it at the cursor, making it the current item.
+func (ds *dataStore) PullItemFromTarget(t *Target) {
+	if t.list == nil {
+		Log("Target not set.")
+		return
+	}
+	pos := t.itemIndex()
+	if pos < 0 {
+		Log("Nothing at Target to pull.")
+		return
+	}
+	n := t.list.sublist[pos]
+	if n.enter != nil {
+		Log("Not an item of the tree.")
+		return
+	}
+	for _, p := range ds.currentList.ancestry() {
+		if p == n {
+			Log("Cannot pull an item into itself.")
+			return
 		}
-		(*kids)[i] = ds.currentItem
 	}
-	ds.currentItem.parent = t.list
+	if b := ds.otherFile(t.list); b != nil {
+		ds.pullFromBuffer(b, t)
+		return
+	}
 
-	// Maybe advance Target index, depending on type of Target. Behaviour
-	// is determined by what the end effect is of moving multiple items
-	// using these Targets:
-	// "Before" Targets: desired effect = reverse chronological addition
-	// "After" Targets: desired effect = chronological addition
-	if !t.before {
+	// Insert where the cursor is, accounting for the removal if pulling
+	// from earlier in the same list.
+	i := max(ds.currentItemIndex(), 0)
+	if t.list == ds.currentList && pos < i {
+		i -= 1
+	}
+	t.take()
+	ds.currentList.insertKid(i, n)
+	// Keep an "After" Target on the same gap in the list. "Before" Targets
+	// stay put, as they do on insert().
+	if t.list == ds.currentList && !t.before && i <= t.index {
 		t.index += 1
 	}
+	ds.setCurrentItemUsingIndex(i)
 
-	// Finally make sure current item is its former successor.
-	ds.currentItem = newCurrentItem
-
+	ds.forgetUndo()
 	ds.dirty = true
 }
 
@@ -345,6 +509,7 @@ func (ds *dataStore) unfoldItems() {
 	// Update current item.
 	ds.setCurrentItemUsingIndex(i)
 
+	ds.forgetUndo()
 	ds.dirty = true
 }
 
@@ -372,11 +537,9 @@ func (ds *dataStore) foldTaggedItemsUnder(name string) {
 	*kids = listUntagged
 
 	// Create new node for fold.
-	nFold := node{
-		name,           // payload
-		ds.currentList, // parent
-		listTagged,     // sublist
-		false,          // tagged
+	nFold := newNode(name)
+	for _, k := range listTagged {
+		nFold.insertKid(len(nFold.sublist), k)
 	}
 
 	// Insert the new node into current list.
@@ -384,11 +547,12 @@ func (ds *dataStore) foldTaggedItemsUnder(name string) {
 	if i > len(*kids) {
 		i = len(*kids)
 	}
-	ds.currentList.insertKid(i, &nFold)
+	ds.currentList.insertKid(i, nFold)
 
 	// Adjust current item.
-	ds.currentItem = &nFold
+	ds.currentItem = nFold
 
+	ds.forgetUndo()
 	ds.dirty = true
 }
 
@@ -419,32 +583,28 @@ func (ds *dataStore) moveItemToIndex(idxNew int) {
 		sublistNew = append(sublistNew, ds.currentItem)
 	}
 	ds.currentList.sublist = sublistNew
-	ds.dirty = true
+	ds.forgetUndo()
+	ds.changedList(ds.currentList)
 }
 
 // Advance currentItem.
 func (ds *dataStore) nextItem() {
 	list := ds.currentList.sublist
-	for i, kid := range list {
-		if kid == ds.currentItem {
-			if i < len(list)-1 {
-				ds.setCurrentItemUsingIndex(i + 1)
-			}
-			return
-		}
+	if ds.currentItem == nil {
+		return
+	}
+	if i := ds.indexOfItem(ds.currentItem); i >= 0 && i < len(list)-1 {
+		ds.setCurrentItemUsingIndex(i + 1)
 	}
 }
 
 // Back up currentItem.
 func (ds *dataStore) prevItem() {
-	list := ds.currentList.sublist
-	for i, kid := range list {
-		if kid == ds.currentItem {
-			if i > 0 {
-				ds.setCurrentItemUsingIndex(i - 1)
-			}
-			return
-		}
+	if ds.currentItem == nil {
+		return
+	}
+	if i := ds.indexOfItem(ds.currentItem); i > 0 {
+		ds.setCurrentItemUsingIndex(i - 1)
 	}
 }
 
@@ -457,9 +617,41 @@ func (ds *dataStore) lastItem() {
 	ds.setCurrentItemUsingIndex(len(*l) - 1)
 }
 
+// Selects item at index 'idx', or the nearest one if no such item.
+func (ds *dataStore) nthItem(idx int) {
+	l := &ds.currentList.sublist
+	if len(*l) == 0 {
+		return
+	}
+	ds.setCurrentItemUsingIndex(max(0, min(idx, len(*l)-1)))
+}
+
 func (ds *dataStore) focusDescend() {
+	if v := ds.currentList.view; v != nil && ds.currentItem != nil {
+		if v.open != nil {
+			v.open(ds.currentItem)
+		} else {
+			// Items of a view live elsewhere; go there.
+			ds.goToNode(ds.currentItem)
+		}
+		return
+	}
+	if ds.currentItem != nil && ds.currentItem.enter != nil {
+		ds.currentItem.enter()
+		return
+	}
+	if ds.currentItem != nil && ds.currentItem.resolve().query != "" {
+		ds.showQueryResults(ds.currentItem.resolve())
+		return
+	}
 	if ds.currentItem != nil {
-		ds.currentList = ds.currentItem
+		if ds.currentItem.link != nil {
+			ds.linkTrail = append(ds.linkTrail, ds.currentItem)
+		}
+		ds.currentList = ds.currentItem.resolve()
+		if m := ds.currentList.mount; m != nil && !m.loaded {
+			ds.loadMount(ds.currentList)
+		}
 		if len(ds.currentList.sublist) > 0 {
 			ds.setCurrentItemUsingIndex(0)
 		} else {
@@ -478,82 +670,383 @@ func (ds *dataStore) focusAscend() {
 		return
 	}
 	newCurrentItem := ds.currentList
-	ds.currentList = ds.currentList.parent
+	newCurrentList := ds.currentList.parent
+	if v := ds.currentList.view; v != nil {
+		// Views are not on their parent list; return to where we were.
+		newCurrentItem = v.origin
+	} else if i := len(ds.linkTrail) - 1; i >= 0 && ds.linkTrail[i].resolve() == ds.currentList {
+		// Likewise for the item shown by a link, if that is how we got here.
+		if l := ds.linkTrail[i]; l.parent != nil {
+			newCurrentItem, newCurrentList = l, l.parent
+		}
+		ds.linkTrail = ds.linkTrail[:i]
+	}
+	ds.currentList = newCurrentList
 	ds.setCurrentItemUsingIndex(ds.indexOfItem(newCurrentItem))
 
 	// TODO: push this off to cmd*()
 	//vd.paneMain.Title = ds.currentList().label
 }
 
-func mapToId(n *node, m *map[*node]int, freeId *int) {
-	if _, ok := (*m)[n]; ok {
-		// Node already in map.
+// Shows 'items' as a list of their own, like a sublist of the current list,
+// but without them leaving the lists they are on.
+func (ds *dataStore) enterView(label string, items []*node, describe func(*node) string) {
+	v := newNode(label)
+	v.parent = ds.currentList
+	v.sublist = items
+	v.view = &listView{origin: ds.currentItem, describe: describe}
+	ds.currentList = v
+	ds.setCurrentItemUsingIndex(min(0, len(items)-1))
+}
+
+// Makes the ancestor at given depth (root being 0) of the current list the
+// new current list, with the cursor on the item leading back down.
+func (ds *dataStore) focusAncestor(depth int) {
+	path := ds.currentList.ancestry()
+	if depth < 0 || depth >= len(path)-1 {
+		Log("No ancestor at depth %d.", depth)
 		return
 	}
-	// Grab fresh ID before visiting kids.
-	(*m)[n] = *freeId
-	*freeId += 1
-	for _, kid := range n.sublist {
-		mapToId(kid, m, freeId)
+	ds.currentList = path[depth]
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(path[depth+1]))
+	ds.linkTrail = nil
+}
+
+// Makes 'n' the current item, switching to whatever list it is on.
+func (ds *dataStore) goToNode(n *node) {
+	if n.parent == nil {
+		Log("Cannot go to root item.")
+		return
 	}
+	ds.currentList = n.parent
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(n))
+	ds.linkTrail = nil
 }
 
-func (ds *dataStore) save() {
-	// First, if file exists, attempt to move old version to backup
-	// filename.
-	if _, err := os.Stat(*filename); err == nil && *backupSuffix != "" {
-		exec.Command("cp", "-a", *filename, *filename+*backupSuffix).Run()
+// Finds next item, after the current one, whose label or note contains
+// 's' (ignoring case), and goes to it. Search covers the whole tree, in
+// depth first order, wrapping around at its end.
+func (ds *dataStore) searchNext(s string) {
+	s = strings.ToLower(s)
+	nodes := ds.root.preorder()
+	start := 0
+	for i, n := range nodes {
+		if n == ds.currentItem {
+			start = i
+			break
+		}
+	}
+	for j := 1; j <= len(nodes); j++ {
+		n := nodes[(start+j)%len(nodes)]
+		if n == ds.root {
+			continue
+		}
+		if strings.Contains(strings.ToLower(n.label), s) ||
+			strings.Contains(strings.ToLower(n.note), s) {
+			ds.goToNode(n)
+			return
+		}
 	}
+	Log("Not found: %q.", s)
+}
+
+// Sets note of current item.
+func (ds *dataStore) setNote(s string) {
+	if ds.currentItem == nil {
+		return
+	}
+	n := ds.currentItem.resolve()
+	changeItem(n, func() { n.note = s })
+	ds.changedList(n.parent)
+}
 
-	f, err := os.Create(*filename)
-	defer f.Close()
+// Formats a line carrying attribute 'keyword' of node 'id'. The value is
+// quoted, as it may span several lines.
+func formatNodeAttr(keyword string, id int, value string) string {
+	return fmt.Sprintf("%s %d %s\n", keyword, id, strconv.Quote(value))
+}
 
+// Reverse of formatNodeAttr(), for a line with its keyword already stripped.
+func parseNodeAttr(l string) (int, string, error) {
+	fields := strings.SplitN(l, " ", 2)
+	if len(fields) < 2 {
+		return 0, "", fmt.Errorf("missing value")
+	}
+	id, err := strconv.Atoi(fields[0])
 	if err != nil {
-		fmt.Printf("Error saving to %q: %q\n", filename, err)
-		return
+		return 0, "", err
 	}
+	value, err := strconv.Unquote(fields[1])
+	if err != nil {
+		return 0, "", err
+	}
+	return id, value, nil
+}
 
-	// Pre-work: map each node to a unique ID.
-	nodeMap := make(map[*node]int)
-	freeId := 1
-	mapToId(ds.root, &nodeMap, &freeId)
+// A whole tree, as kept in a file: its root, and its special lists (nil if it
+// has none).
+type fileTree struct {
+	root  *node
+	done  *node
+	trash *node
+	// Highest node id ever saved in the file; ids of nodes since removed
+	// are not to be given out again, as other copies of the file may
+	// still have them.
+	lastId int
+}
 
-	// First, write out special node ids.
+// Returns the tree of the data store, for saving.
+func (ds *dataStore) tree() fileTree {
+	t := fileTree{root: ds.root}
 	if ds.markDone != nil {
-		idDone := nodeMap[ds.markDone.list]
-		f.WriteString(fmt.Sprintf("DONE %v\n", idDone))
+		t.done = ds.markDone.list
 	}
 	if ds.markTrash != nil {
-		idTrash := nodeMap[ds.markTrash.list]
-		f.WriteString(fmt.Sprintf("TRASH %v\n", idTrash))
+		t.trash = ds.markTrash.list
+	}
+	for _, n := range ds.root.preorder() {
+		ds.lastId = max(ds.lastId, n.id)
 	}
+	t.lastId = ds.lastId
+	return t
+}
 
-	// Finally, write out nodes in breadth first order.
-	nToDo := []*node{ds.root}
-	var n *node
-	for len(nToDo) > 0 {
-		n, nToDo = nToDo[0], nToDo[1:]
-		f.WriteString(fmt.Sprintf("node %v\n", nodeMap[n]))
-		f.WriteString(fmt.Sprintf("%s\n", n.label))
-		// TODO: get rid of trailing space after last item; use some
-		// join()
+// Writes out tree in file format. Buffered; 'w' gets it in large writes.
+// Writes nothing if the tree is found broken.
+func (t fileTree) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	// Pre-work: make sure no two nodes share an id. Should never happen;
+	// if it does, the tree is broken somehow, and saving it would only make
+	// that last (links and references to either node being ambiguous).
+	nodes := t.root.preorder()
+	seen := make(map[int]*node)
+	for _, n := range nodes {
+		if m := seen[n.id]; m != nil {
+			return fmt.Errorf("node id %d in use twice, by %q and %q", n.id, m.label, n.label)
+		}
+		seen[n.id] = n
+	}
+
+	// First, write out special node ids.
+	if t.lastId > 0 {
+		fmt.Fprintf(bw, "LASTID %v\n", t.lastId)
+	}
+	if t.done != nil {
+		fmt.Fprintf(bw, "DONE %v\n", t.done.id)
+	}
+	if t.trash != nil {
+		fmt.Fprintf(bw, "TRASH %v\n", t.trash.id)
+	}
+
+	// Finally, write out nodes in order of their ids. As ids never
+	// change, neither does the order, so that small changes to the tree
+	// make for small changes to the file.
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	// Lines of a node are put together here, reused from node to node, as
+	// there may be very many.
+	var b []byte
+	for _, n := range nodes {
+		// A link to an item not in the tree would not load back; it is
+		// saved as a plain item instead, with the label of that item.
+		label, link := n.label, n.link
+		if link != nil && seen[link.id] != link {
+			Log("WARNING: Link %d is to item %q, not in the tree; saved as a plain item.",
+				n.id, link.label)
+			label, link = link.label, nil
+		}
+		b = append(b[:0], "node "...)
+		b = strconv.AppendInt(b, int64(n.id), 10)
+		b = append(b, '\n')
+		b = append(b, label...)
+		b = append(b, '\n')
+		sep := false
 		for _, child := range n.sublist {
-			f.WriteString(fmt.Sprintf("%v ", nodeMap[child]))
+			if child.enter == nil && n.mount == nil {
+				if sep {
+					b = append(b, ' ')
+				}
+				b = strconv.AppendInt(b, int64(child.id), 10)
+				sep = true
+			}
 		}
 		// NOTE: if no children, will result in blank line.
 		// (intentional)
-		f.WriteString("\n")
+		b = append(b, '\n')
+		bw.Write(b)
+
+		// Optional attributes follow the node they belong to.
+		if n.note != "" {
+			bw.WriteString(formatNodeAttr("NOTE", n.id, n.note))
+		}
+		if !n.due.IsZero() {
+			bw.WriteString(formatNodeAttr("DUE", n.id, n.due.Format(DATE_FORMAT)))
+		}
+		if !n.scheduled.IsZero() {
+			bw.WriteString(formatNodeAttr("SCHED", n.id, n.scheduled.Format(DATE_FORMAT)))
+		}
+		if n.repeat != "" {
+			bw.WriteString(formatNodeAttr("REPEAT", n.id, n.repeat))
+		}
+		if n.priority != 0 {
+			bw.WriteString(formatNodeAttr("PRIO", n.id, strconv.Itoa(n.priority)))
+		}
+		if n.query != "" {
+			bw.WriteString(formatNodeAttr("QUERY", n.id, n.query))
+		}
+		if link != nil {
+			bw.WriteString(formatNodeAttr("LINK", n.id, strconv.Itoa(link.id)))
+		}
+		if n.mount != nil {
+			bw.WriteString(formatNodeAttr("MOUNT", n.id, n.mount.path))
+		}
+	}
+	return bw.Flush()
+}
 
-		nToDo = append(nToDo, n.sublist...)
+func (ds *dataStore) save() {
+	if ds.readOnly {
+		Log("Read-only; not saved.")
+		return
+	}
+	if ds.sealed != nil {
+		Log("%q is encrypted and not unlocked; not saved.", ds.filename)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := ds.tree().write(&buf); err != nil {
+		Log("Error saving %q: %v; not saved.", ds.filename, err)
+		return
+	}
+	data := buf.Bytes()
+	if ds.crypt != nil {
+		var err error
+		if data, err = ds.crypt.seal(data); err != nil {
+			Log("Error encrypting %q: %v; not saved.", ds.filename, err)
+			return
+		}
+	}
+
+	// First, if file exists, attempt to move old version to backup
+	// filename.
+	if _, err := os.Stat(ds.filename); err == nil && *backupSuffix != "" {
+		exec.Command("cp", "-a", ds.filename, ds.filename+*backupSuffix).Run()
+	}
+
+	if err := writeFileAtomic(ds.filename, data, 0644); err != nil {
+		Log("Error saving to %q: %v.", ds.filename, err)
+		return
+	}
+	ds.disk.saw(ds.filename, data)
+	ds.removeJournal()
+	ds.saveMounts(ds.root)
+	if *keepHistory && ds.crypt != nil {
+		Log("Saved, but not to history, as encrypted.")
+	} else if *keepHistory {
+		if err := ds.recordHistory(ds.tree()); err != nil {
+			Log("Saved, but not to history: %v.", err)
+		}
 	}
 
 	ds.dirty = false
-	Log("Saved to %q.", *filename)
+	Log("Saved to %q.", ds.filename)
 }
 
 func (ds *dataStore) load() {
-	// First wipe any data we have.
-	ds.root = nil
+	data, err := ioutil.ReadFile(ds.filename)
+	if err != nil {
+		Log("Error reading %q: %v.", ds.filename, err)
+		return
+	}
+	plain, err := ds.decrypt(data)
+	if err == errNoPassphrase {
+		// Keep what we have, until unlocked; see cmdUnlock().
+		ds.sealed = data
+		Log("%q is encrypted; enter passphrase to unlock.", ds.filename)
+		return
+	}
+	if err != nil {
+		Log("Error loading %q: %v.", ds.filename, err)
+		return
+	}
+
+	// Any data we have is kept, unless the file parses.
+	t, err := parseTree(plain)
+	if err != nil {
+		Log("Error loading %q: %v.", ds.filename, err)
+		return
+	}
+	ds.undo = nil
+	ds.linkTrail = nil
+	ds.setTree(t)
+	ds.disk.saw(ds.filename, data)
+	ds.sealed = nil
+	ds.removeJournal()
+
+	ds.dirty = false
+	Log("Loaded %q.", ds.filename)
+}
+
+// Makes 't' the tree being edited, with cursor at its top.
+func (ds *dataStore) setTree(t fileTree) {
+	old := ds.root
+	ds.root = t.root
+	ds.lastId = t.lastId
+	ds.markDone, ds.markTrash = nil, nil
+	if t.done != nil {
+		ds.markDone = &Target{t.done, 0, true}
+	}
+	if t.trash != nil {
+		ds.markTrash = &Target{t.trash, 0, true}
+	}
+	if old != nil {
+		ds.ensureFileLists()
+		ds.remapTarget(old)
+	}
+
+	ds.ensureRecentItem()
+
+	ds.currentList = ds.root
+	ds.currentItem = nil
+	if len(ds.root.sublist) > 0 {
+		ds.setCurrentItemUsingIndex(0)
+	}
+}
+
+// Moves Target, if on a list of tree 'old' which the tree of the buffer has
+// replaced, to the list with the same id in the new one; else clears it.
+// Lists of files mounted have ids of their own, so Target on one is cleared.
+func (ds *dataStore) remapTarget(old *node) {
+	if ds.Mark == nil || ds.Mark.list == nil || ds.Mark.list.ancestry()[0] != old {
+		return
+	}
+	var n *node
+	if mountOfList(ds.Mark.list) == nil {
+		n = ds.nodeById(ds.Mark.list.id)
+	}
+	if n == nil {
+		*ds.Mark = Target{}
+		return
+	}
+	ds.Mark.list = n
+	ds.Mark.index = min(ds.Mark.index, len(n.sublist)-1)
+}
+
+// Parses file contents back into a tree.
+func parseTree(data []byte) (fileTree, error) {
+	if isEncrypted(data) {
+		return fileTree{}, fmt.Errorf("encrypted; open it in loled to enter passphrase")
+	}
+	return parseTreeFrom(bytes.NewReader(data))
+}
+
+// Longest line parseTreeFrom() takes (notes being on one line, escaped).
+const PARSE_LINE_MAX = 1 << 30
+
+// Parses a tree, as saved, from 'r'; line by line, as read.
+func parseTreeFrom(r io.Reader) (fileTree, error) {
+	var t fileTree
 
 	// We will need to build up a map, to better link things.
 	type nodeData struct {
@@ -562,25 +1055,23 @@ func (ds *dataStore) load() {
 	}
 	nodeMap := make(map[int]nodeData)
 
-	data, err := ioutil.ReadFile(*filename)
-	if err != nil {
-		fmt.Printf("Error reading %q: %q\n", filename, err)
-		return
-	}
-
 	var idDone = -1
 	var idTrash = -1
-
-	lines := strings.Split(string(data), "\n")
+	notes := make(map[int]string)
+	repeats := make(map[int]string)
+	queries := make(map[int]string)
+	mounts := make(map[int]string)
+	links := make(map[int]int)
+	priorities := make(map[int]int)
+	dues := make(map[int]time.Time)
+	scheduleds := make(map[int]time.Time)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), PARSE_LINE_MAX)
 
 	var l string
-	for {
-		// If ran out of input, we are done.
-		if len(lines) < 1 {
-			break
-		}
-
-		l = pop(&lines)
+	for sc.Scan() {
+		l = sc.Text()
 
 		// Skip any blank lines.
 		if strings.Trim(l, whitespace) == "" {
@@ -592,37 +1083,123 @@ func (ds *dataStore) load() {
 			l = l[5:]
 			id, err := strconv.Atoi(l)
 			if err != nil {
-				panic(err)
+				return t, fmt.Errorf("format error in DONE: %v", err)
 			}
 			idDone = id
 			continue
 		}
+		if strings.HasPrefix(l, "LASTID ") {
+			id, err := strconv.Atoi(l[7:])
+			if err != nil {
+				return t, fmt.Errorf("format error in LASTID: %v", err)
+			}
+			t.lastId = id
+			reserveNodeId(id)
+			continue
+		}
 		if strings.HasPrefix(l, "TRASH ") {
 			l = l[6:]
 			id, err := strconv.Atoi(l)
 			if err != nil {
-				panic(err)
+				return t, fmt.Errorf("format error in TRASH: %v", err)
 			}
 			idTrash = id
 			continue
 		}
 
+		// Then for optional attributes of nodes.
+		if strings.HasPrefix(l, "NOTE ") {
+			id, note, err := parseNodeAttr(l[5:])
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			notes[id] = note
+			continue
+		}
+		if strings.HasPrefix(l, "REPEAT ") {
+			id, rule, err := parseNodeAttr(l[7:])
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			repeats[id] = rule
+			continue
+		}
+		if strings.HasPrefix(l, "QUERY ") {
+			id, q, err := parseNodeAttr(l[6:])
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			queries[id] = q
+			continue
+		}
+		if strings.HasPrefix(l, "MOUNT ") {
+			id, path, err := parseNodeAttr(l[6:])
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			mounts[id] = path
+			continue
+		}
+		if strings.HasPrefix(l, "LINK ") {
+			id, value, err := parseNodeAttr(l[5:])
+			var target int
+			if err == nil {
+				target, err = strconv.Atoi(value)
+			}
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			links[id] = target
+			continue
+		}
+		if strings.HasPrefix(l, "PRIO ") {
+			id, value, err := parseNodeAttr(l[5:])
+			var p int
+			if err == nil {
+				p, err = strconv.Atoi(value)
+			}
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			priorities[id] = p
+			continue
+		}
+		if strings.HasPrefix(l, "DUE ") || strings.HasPrefix(l, "SCHED ") {
+			keyword := strings.SplitN(l, " ", 2)[0]
+			id, value, err := parseNodeAttr(l[len(keyword)+1:])
+			var d time.Time
+			if err == nil {
+				d, err = time.ParseInLocation(DATE_FORMAT, value, time.Local)
+			}
+			if err != nil {
+				return t, fmt.Errorf("format error in %q: %v", l, err)
+			}
+			if keyword == "DUE" {
+				dues[id] = d
+			} else {
+				scheduleds[id] = d
+			}
+			continue
+		}
+
 		// If not any above, then it should be a node definition.
 		if !strings.HasPrefix(l, "node ") {
-			fmt.Printf("Format error: expected node #, got %q.\n", l)
-			return
+			return t, fmt.Errorf("format error: expected node #, got %q", l)
 		}
 
 		l = l[5:] // Strip "node ".
 		id, err := strconv.Atoi(l)
-
 		if err != nil {
-			panic(err)
+			return t, fmt.Errorf("format error in node %q: %v", l, err)
 		}
 
-		label := pop(&lines)
-
-		l = strings.Trim(pop(&lines), whitespace)
+		// Label and kids follow, on lines of their own.
+		if !sc.Scan() {
+			return t, fmt.Errorf("format error: node %d cut short", id)
+		}
+		label := sc.Text()
+		sc.Scan()
+		l = strings.Trim(sc.Text(), whitespace)
 		var idKids []int
 		if len(l) > 0 {
 			// SOME kids
@@ -631,7 +1208,7 @@ func (ds *dataStore) load() {
 			for i, s := range kids {
 				idKids[i], err = strconv.Atoi(s)
 				if err != nil {
-					panic(err)
+					return t, fmt.Errorf("format error in kids of node %d: %v", id, err)
 				}
 			}
 		} else {
@@ -639,48 +1216,102 @@ func (ds *dataStore) load() {
 			idKids = make([]int, 0)
 		}
 
-		// Create the node.
-		n := node{
-			label,
-			nil,   // parent; TBD
-			nil,   // kids; TBD
-			false, // tagged
+		if _, ok := nodeMap[id]; ok {
+			return t, fmt.Errorf("format error: node %d defined twice", id)
 		}
+
+		// Create the node, keeping its id; parent & kids TBD.
+		n := newNode(label)
+		n.id = id
+		reserveNodeId(id)
 		nodeMap[id] = nodeData{
-			&n,
+			n,
 			idKids,
 		}
 		if label == "root" && (id == 0 || id == 1) {
-			ds.root = &n
+			t.root = n
 		}
 	}
 
+	if err := sc.Err(); err != nil {
+		return t, fmt.Errorf("reading: %v", err)
+	}
+	if t.root == nil {
+		return t, fmt.Errorf("format error: no root node")
+	}
+
 	// Readjust parent & kid pointers.
-	for _, ndata := range nodeMap {
+	for id, ndata := range nodeMap {
 		for _, idKid := range ndata.kids {
-			ndata.n.sublist = append(ndata.n.sublist, nodeMap[idKid].n)
-			nodeMap[idKid].n.parent = ndata.n
+			kdata, ok := nodeMap[idKid]
+			if !ok {
+				return t, fmt.Errorf("format error: node %d has unknown kid %d", id, idKid)
+			}
+			ndata.n.sublist = append(ndata.n.sublist, kdata.n)
+			kdata.n.parent = ndata.n
 		}
 	}
 
-	// Handle special Targets.
-	if idDone > 0 {
-		n := nodeMap[idDone].n
-		ds.markDone = &Target{n, 0, true}
+	for id, note := range notes {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.note = note
+		}
 	}
-	if idTrash > 0 {
-		n := nodeMap[idTrash].n
-		ds.markTrash = &Target{n, 0, true}
+	for id, rule := range repeats {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.repeat = rule
+		}
 	}
-
-	ds.currentList = ds.root
-	ds.currentItem = nil
-	if len(ds.root.sublist) > 0 {
-		ds.setCurrentItemUsingIndex(0)
+	for id, q := range queries {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.query = q
+		}
+	}
+	for id, path := range mounts {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.mount = newMount(path)
+		}
+	}
+	for id, target := range links {
+		ndata, ok := nodeMap[id]
+		if !ok {
+			continue
+		}
+		// A link to a node not in the file is left a plain item, rather
+		// than the whole file unreadable.
+		tdata, ok := nodeMap[target]
+		if !ok {
+			if ndata.n.label == "" {
+				ndata.n.label = fmt.Sprintf("(link to missing node %d)", target)
+			}
+			continue
+		}
+		ndata.n.link = tdata.n
+	}
+	for id, p := range priorities {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.priority = p
+		}
+	}
+	for id, d := range dues {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.due = d
+		}
+	}
+	for id, d := range scheduleds {
+		if ndata, ok := nodeMap[id]; ok {
+			ndata.n.scheduled = d
+		}
 	}
 
-	ds.dirty = false
-	Log("Loaded %q.", *filename)
+	// Handle special lists.
+	if ndata, ok := nodeMap[idDone]; ok {
+		t.done = ndata.n
+	}
+	if ndata, ok := nodeMap[idTrash]; ok {
+		t.trash = ndata.n
+	}
+	return t, nil
 }
 
 // vim: fdm=syntax
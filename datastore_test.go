@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteRefusesDuplicateIds(t *testing.T) {
+	b := testBuffer(t, "a", "b")
+	a, c := itemsLabelled(b.root, "a")[0], itemsLabelled(b.root, "b")[0]
+	c.id = a.id
+	var buf bytes.Buffer
+	if err := b.tree().write(&buf); err == nil {
+		t.Error("tree with duplicate ids written")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes", buf.Len())
+	}
+	if c.id != a.id {
+		t.Error("id renumbered")
+	}
+}
+
+func TestReloadMovesTarget(t *testing.T) {
+	*keepHistory = false
+	b := testBuffer(t, "a", "b")
+	a := itemsLabelled(b.root, "a")[0]
+	b.setCurrentItemUsingIndex(b.root.indexOf(a))
+	b.focusDescend()
+	b.appendItem("kid")
+	b.SetUserTarget()
+	b.save()
+
+	b.load()
+	if b.Mark.list == a || b.Mark.list == nil {
+		t.Fatal("Target left on the tree replaced")
+	}
+	if b.Mark.list.id != a.id || b.Mark.list.ancestry()[0] != b.root {
+		t.Errorf("Target moved to %q", b.Mark.list.label)
+	}
+	for _, l := range []*node{b.markDone.list, b.markTrash.list} {
+		if l.ancestry()[0] != b.root {
+			t.Errorf("%q not in the tree", l.label)
+		}
+	}
+}
+
+// What write() saves of an item, for comparing trees.
+func savedOf(n *node) []interface{} {
+	link, mount := 0, ""
+	if n.link != nil {
+		link = n.link.id
+	}
+	if n.mount != nil {
+		mount = n.mount.path
+	}
+	kids := []int{}
+	for _, kid := range n.sublist {
+		if kid.enter == nil {
+			kids = append(kids, kid.id)
+		}
+	}
+	return []interface{}{n.id, n.label, n.note, n.due.Format(DATE_FORMAT),
+		n.scheduled.Format(DATE_FORMAT), n.repeat, n.priority, n.query,
+		link, mount, kids}
+}
+
+func TestWriteParse(t *testing.T) {
+	due := time.Date(2026, 10, 23, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		// Adds to buffer with items "a" and "b", "a" current.
+		add func(b *dataStore)
+	}{
+		{"plain", func(b *dataStore) {}},
+		{"attributes", func(b *dataStore) {
+			n := b.currentItem
+			n.note = "two\nlines \"quoted\""
+			n.due, n.scheduled = due, due.AddDate(0, 0, -1)
+			n.repeat = "weekly"
+			n.priority = 2
+		}},
+		{"nested", func(b *dataStore) {
+			b.focusDescend()
+			b.appendItem("kid")
+			b.focusDescend()
+			b.appendItem("grandkid")
+		}},
+		{"link", func(b *dataStore) {
+			b.SetUserTarget()
+			b.LinkCurrentItemAtTarget(b.Mark)
+		}},
+		{"link into a list", func(b *dataStore) {
+			b.SetUserTarget()
+			b.focusDescend()
+			b.appendItem("kid")
+			b.LinkCurrentItemAtTarget(b.Mark)
+		}},
+		{"mount", func(b *dataStore) {
+			b.appendMount("other.lol")
+		}},
+		{"query", func(b *dataStore) {
+			b.appendItem("smart").query = "#tag"
+		}},
+		{"ids not in order", func(b *dataStore) {
+			b.currentItem.id = lastNodeId + 10
+			reserveNodeId(b.currentItem.id)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBuffer(t, "a", "b")
+			b.setCurrentItemUsingIndex(b.root.indexOf(itemsLabelled(b.root, "a")[0]))
+			tt.add(b)
+			saved := b.tree()
+			got := testReload(t, b)
+
+			if got.lastId != saved.lastId {
+				t.Errorf("LASTID %d, want %d", got.lastId, saved.lastId)
+			}
+			if got.done == nil || got.done.id != saved.done.id ||
+				got.trash == nil || got.trash.id != saved.trash.id {
+				t.Errorf("DONE or TRASH not loaded")
+			}
+			want := []*node{}
+			for _, n := range saved.root.preorder() {
+				if n.enter == nil {
+					want = append(want, n)
+				}
+			}
+			have := got.root.preorder()
+			if len(have) != len(want) {
+				t.Fatalf("%d items loaded, want %d", len(have), len(want))
+			}
+			for i := range want {
+				if w, h := savedOf(want[i]), savedOf(have[i]); !reflect.DeepEqual(h, w) {
+					t.Errorf("loaded %v, want %v", h, w)
+				}
+				if l := have[i].link; l != nil && l.ancestry()[0] != got.root {
+					t.Errorf("link %d to a node not in the tree", have[i].id)
+				}
+			}
+		})
+	}
+}
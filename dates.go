@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of dates, as stored and as accepted in input.
+const DATE_FORMAT = "2006-01-02"
+
+// How many days ahead the agenda looks for upcoming items.
+const AGENDA_DAYS = 7
+
+// Prefixes marking dates within labels, e.g. "pay rent due:fri".
+const (
+	PFX_DUE       = "due:"
+	PFX_SCHEDULED = "sched:"
+	PFX_REPEAT    = "repeat:"
+)
+
+// Dates of an item, as given in text.
+type dateSpec struct {
+	due       time.Time
+	scheduled time.Time
+	// Recurrence rule; see nextOccurrence().
+	repeat string
+}
+
+// Returns start of today, local time.
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// Parses a date given in shorthand, relative to 'today'. Understood are:
+// - today, tomorrow, yesterday
+// - offsets such as +3d, -1w, +2m, +1y (or just +3, meaning days)
+// - weekdays such as fri or friday, meaning the nearest one from today on
+// - ISO dates such as 2026-10-20
+func parseDate(s string, today time.Time) (time.Time, error) {
+	s = strings.ToLower(strings.Trim(s, whitespace))
+	switch s {
+	case "today":
+		return today, nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+
+	if t, err := time.ParseInLocation(DATE_FORMAT, s, time.Local); err == nil {
+		return t, nil
+	}
+
+	if len(s) > 1 && (s[0] == '+' || s[0] == '-') {
+		digits, unit := s[1:], byte('d')
+		if !isDigit(s[len(s)-1]) {
+			digits, unit = s[1:len(s)-1], s[len(s)-1]
+		}
+		n, err := strconv.Atoi(digits)
+		if err == nil {
+			if s[0] == '-' {
+				n = -n
+			}
+			switch unit {
+			case 'd':
+				return today.AddDate(0, 0, n), nil
+			case 'w':
+				return today.AddDate(0, 0, 7*n), nil
+			case 'm':
+				return today.AddDate(0, n, 0), nil
+			case 'y':
+				return today.AddDate(n, 0, 0), nil
+			}
+		}
+	}
+
+	if wd, ok := parseWeekday(s); ok {
+		days := (int(wd) - int(today.Weekday()) + 7) % 7
+		return today.AddDate(0, 0, days), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unknown date %q", s)
+}
+
+// Parses weekday names, full or abbreviated to three letters (e.g., fri).
+func parseWeekday(s string) (time.Weekday, bool) {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		name := strings.ToLower(wd.String())
+		if s == name || s == name[:3] {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+// Splits date tokens (e.g., "due:fri", "sched:+2d", "repeat:weekly") out of
+// 's'. Returns the remaining text, and the dates found (zero if not given).
+func splitDateTokens(s string, today time.Time) (string, dateSpec, error) {
+	var spec dateSpec
+	rest := []string{}
+	found := false
+	for _, word := range strings.Fields(s) {
+		lower := strings.ToLower(word)
+		var d *time.Time
+		switch {
+		case strings.HasPrefix(lower, PFX_DUE):
+			d, word = &spec.due, word[len(PFX_DUE):]
+		case strings.HasPrefix(lower, PFX_SCHEDULED):
+			d, word = &spec.scheduled, word[len(PFX_SCHEDULED):]
+		case strings.HasPrefix(lower, PFX_REPEAT):
+			spec.repeat = lower[len(PFX_REPEAT):]
+			if _, err := nextOccurrence(spec.repeat, time.Time{}, today); err != nil {
+				return s, dateSpec{}, err
+			}
+			found = true
+			continue
+		default:
+			rest = append(rest, word)
+			continue
+		}
+		t, err := parseDate(word, today)
+		if err != nil {
+			return s, dateSpec{}, err
+		}
+		*d = t
+		found = true
+	}
+	if !found {
+		// Leave spacing of the text alone.
+		return s, spec, nil
+	}
+	return strings.Join(rest, " "), spec, nil
+}
+
+// Takes any date tokens out of the label of 'n', setting its dates instead.
+func (n *node) takeDateTokens(today time.Time) {
+	label, spec, err := splitDateTokens(n.label, today)
+	if err != nil {
+		Log("Dates left in label: %v.", err)
+		return
+	}
+	n.label = label
+	if !spec.due.IsZero() {
+		n.due = spec.due
+	}
+	if !spec.scheduled.IsZero() {
+		n.scheduled = spec.scheduled
+	}
+	if spec.repeat != "" {
+		n.repeat = spec.repeat
+	}
+}
+
+// Returns dates of 'n' in the form splitDateTokens() accepts.
+func formatDateTokens(n *node) string {
+	tokens := []string{}
+	if !n.due.IsZero() {
+		tokens = append(tokens, PFX_DUE+n.due.Format(DATE_FORMAT))
+	}
+	if !n.scheduled.IsZero() {
+		tokens = append(tokens, PFX_SCHEDULED+n.scheduled.Format(DATE_FORMAT))
+	}
+	if n.repeat != "" {
+		tokens = append(tokens, PFX_REPEAT+n.repeat)
+	}
+	return strings.Join(tokens, " ")
+}
+
+// Works out the date an item repeating by 'rule' is next due, once completed
+// on 'today'. 'prev' is when the completed one was due (zero if not known).
+// Rules are:
+// - daily, weekly, monthly, yearly: keep to the schedule set by 'prev', but
+//   skip any occurrences already past
+// - a weekday such as fri: weekly, on that day
+// - an offset such as +3d or +2w: that long after completion
+func nextOccurrence(rule string, prev, today time.Time) (time.Time, error) {
+	var years, months, days int
+	switch rule {
+	case "daily":
+		days = 1
+	case "weekly":
+		days = 7
+	case "monthly":
+		months = 1
+	case "yearly":
+		years = 1
+	default:
+		if strings.HasPrefix(rule, "+") {
+			return parseDate(rule, today)
+		}
+		if _, ok := parseWeekday(rule); ok {
+			// Next one strictly after today.
+			return parseDate(rule, today.AddDate(0, 0, 1))
+		}
+		return time.Time{}, fmt.Errorf("unknown repeat rule %q", rule)
+	}
+	next := prev
+	if next.IsZero() {
+		next = today
+	}
+	for {
+		next = next.AddDate(years, months, days)
+		if next.After(today) {
+			return next, nil
+		}
+	}
+}
+
+// Returns a fresh copy of recurring item 'n', with its dates moved on to the
+// next occurrence. The copy takes over the recurrence.
+func (n *node) nextRecurrence(today time.Time) (*node, error) {
+	base := n.due
+	if base.IsZero() {
+		base = n.scheduled
+	}
+	next, err := nextOccurrence(n.repeat, base, today)
+	if err != nil {
+		return nil, err
+	}
+	c := n.copyTree()
+	switch {
+	case n.due.IsZero() && !n.scheduled.IsZero():
+		c.scheduled = next
+	case n.scheduled.IsZero():
+		c.due = next
+	default:
+		// Keep scheduled the same number of days ahead of due.
+		c.due = next
+		c.scheduled = next.AddDate(0, 0, daysBetween(n.due, n.scheduled))
+	}
+	n.repeat = ""
+	return c, nil
+}
+
+// Returns number of days from 'a' to 'b'.
+func daysBetween(a, b time.Time) int {
+	// Rounded, as days are not all 24h long (daylight saving time).
+	return int(math.Round(b.Sub(a).Hours() / 24))
+}
+
+// Short form of date 'd', for display next to items.
+func formatShortDate(d, today time.Time) string {
+	if d.Year() == today.Year() {
+		return d.Format("Jan 2")
+	}
+	return d.Format("Jan 2 2006")
+}
+
+// Returns display suffix for dates of 'n', colored by urgency.
+func dateSuffix(n *node, today time.Time) string {
+	s := ""
+	if n.repeat != "" {
+		s = sfxRepeat
+	}
+	if n.due.IsZero() {
+		return s
+	}
+	s = " (due " + formatShortDate(n.due, today) + ")" + s
+	switch {
+	case n.due.Before(today):
+		return colorString(s, FG_RED, BG_BLACK, "")
+	case n.due.Equal(today):
+		return colorString(s, FG_YELLOW, BG_BLACK, "")
+	}
+	return s
+}
+
+// Orders by date, earliest first: the due date, else the scheduled one. Items
+// with neither come last. (Items do not record when they were created or
+// last changed, so there is no ordering by those.)
+func byDate(a, b *node) bool {
+	da, db := a.resolve().due, b.resolve().due
+	if da.IsZero() {
+		da = a.resolve().scheduled
+	}
+	if db.IsZero() {
+		db = b.resolve().scheduled
+	}
+	if da.IsZero() || db.IsZero() {
+		return !da.IsZero() && db.IsZero()
+	}
+	return da.Before(db)
+}
+
+// Sections of the agenda, in the order shown.
+const (
+	AGENDA_OVERDUE = iota
+	AGENDA_TODAY
+	AGENDA_UPCOMING
+	AGENDA_NONE // not on agenda
+)
+
+var agendaSectionNames = []string{"OVERDUE", "TODAY", "UPCOMING"}
+
+// Returns which agenda section 'n' belongs in, and the date it is listed
+// under.
+func agendaSection(n *node, today time.Time) (int, time.Time) {
+	horizon := today.AddDate(0, 0, AGENDA_DAYS)
+	due, scheduled := n.due, n.scheduled
+	switch {
+	case !due.IsZero() && due.Before(today):
+		return AGENDA_OVERDUE, due
+	case !due.IsZero() && due.Equal(today):
+		return AGENDA_TODAY, due
+	case !scheduled.IsZero() && !scheduled.After(today):
+		return AGENDA_TODAY, scheduled
+	case !scheduled.IsZero() && scheduled.Before(horizon):
+		return AGENDA_UPCOMING, scheduled
+	case !due.IsZero() && due.Before(horizon):
+		return AGENDA_UPCOMING, due
+	}
+	return AGENDA_NONE, time.Time{}
+}
+
+// Returns nodes of the tree which are not DONE (or in Trash), in depth first
+// order. Files mounted are left out.
+func (ds *dataStore) openItems() []*node {
+	nodes := []*node{}
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, kid := range n.sublist {
+			if kid == ds.markDone.list || kid == ds.markTrash.list {
+				continue
+			}
+			nodes = append(nodes, kid)
+			if kid.mount == nil {
+				walk(kid)
+			}
+		}
+	}
+	walk(ds.root)
+	return nodes
+}
+
+// Collects open items which are overdue, due or scheduled today, or coming up
+// soon, ordered by section and then date.
+func (ds *dataStore) agendaItems(today time.Time) []*node {
+	items := []*node{}
+	for _, n := range ds.openItems() {
+		if s, _ := agendaSection(n, today); s != AGENDA_NONE {
+			items = append(items, n)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		si, di := agendaSection(items[i], today)
+		sj, dj := agendaSection(items[j], today)
+		if si != sj {
+			return si < sj
+		}
+		return di.Before(dj)
+	})
+	return items
+}
+
+// Marks current item DONE. A recurring item also gets replaced by its next
+// occurrence, which is returned (nil otherwise).
+func (ds *dataStore) completeCurrentItem() *node {
+	n := ds.currentItem
+	if n == nil {
+		return nil
+	}
+	var next *node
+	if n.repeat != "" {
+		var err error
+		if next, err = n.nextRecurrence(today()); err != nil {
+			Log("Not repeating %q: %v.", n.label, err)
+		}
+	}
+	i := ds.currentItemIndex()
+	p := n.parent
+	pi := p.indexOf(n)
+	done, _ := ds.fileLists(p)
+	ds.MoveCurrentItemToTarget(done)
+	if next == nil {
+		return nil
+	}
+
+	// Next one takes the place of the completed one.
+	p.insertKid(pi, next)
+	if v := ds.currentList; v.view != nil {
+		v.sublist = append(v.sublist[:i], append([]*node{next}, v.sublist[i:]...)...)
+	}
+	if ds.currentItem == nil {
+		ds.currentItem = next
+	}
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(ds.currentItem))
+	Log("%q repeats, next: %s.", next.label, formatDateTokens(next))
+	return next
+}
+
+// Shows the agenda as the current list.
+func (ds *dataStore) showAgenda() {
+	t := today()
+	ds.enterView("[agenda]", ds.agendaItems(t), func(n *node) string {
+		s, d := agendaSection(n, t)
+		return fmt.Sprintf("%-8s %-6s ", agendaSectionNames[s],
+			formatShortDate(d, t)) + describeWithPath(n)
+	})
+}
+
+// Sets the dates of current item from 'spec', which holds the same tokens
+// as labels would. A bare date means the due date. Empty 'spec' clears all.
+func (ds *dataStore) setDates(spec string) {
+	if ds.currentItem == nil {
+		return
+	}
+	t := today()
+	rest, dates, err := splitDateTokens(spec, t)
+	if err == nil && strings.Trim(rest, whitespace) != "" {
+		dates.due, err = parseDate(rest, t)
+	}
+	if err != nil {
+		Log("Dates unchanged: %v.", err)
+		return
+	}
+	n := ds.currentItem.resolve()
+	n.due = dates.due
+	n.scheduled = dates.scheduled
+	n.repeat = dates.repeat
+	ds.changedList(n.parent)
+}
+
+// vim: fdm=syntax
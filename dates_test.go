@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	// A Wednesday.
+	today := time.Date(2026, 10, 21, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		s    string
+		want string // or "" if an error
+	}{
+		{"today", "2026-10-21"},
+		{" Tomorrow ", "2026-10-22"},
+		{"yesterday", "2026-10-20"},
+		{"2027-02-03", "2027-02-03"},
+		{"+3", "2026-10-24"},
+		{"+3d", "2026-10-24"},
+		{"-1w", "2026-10-14"},
+		{"+2m", "2026-12-21"},
+		{"+1y", "2027-10-21"},
+		{"wed", "2026-10-21"},
+		{"fri", "2026-10-23"},
+		{"Monday", "2026-10-26"},
+		{"", ""},
+		{"+", ""},
+		{"+3x", ""},
+		{"2026-13-01", ""},
+		{"someday", ""},
+	}
+	for _, tt := range tests {
+		d, err := parseDate(tt.s, today)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parseDate(%q) = %v, want an error", tt.s, d)
+		case tt.want != "" && err != nil:
+			t.Errorf("parseDate(%q): %v", tt.s, err)
+		case tt.want != "" && d.Format(DATE_FORMAT) != tt.want:
+			t.Errorf("parseDate(%q) = %s, want %s", tt.s, d.Format(DATE_FORMAT), tt.want)
+		}
+	}
+}
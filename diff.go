@@ -0,0 +1,293 @@
+package main
+
+// Structural diff of list files:
+//
+//	loled diff [-json] OLD NEW
+//
+// reports items added, removed, renamed, moved, reordered or otherwise changed
+// (note, dates etc.), each by its path. Items are matched by id, so this works
+// for files saved with ids kept for good (as all are now). Exit status is 1 if
+// there are differences, as with diff(1).
+//
+// For git, either have it run the diff itself,
+//
+//	.gitattributes:  *.lol diff=loled
+//	.git/config:     [diff "loled"]
+//	                         command = loled diff
+//
+// or, for use with git's own diff output, turn files into indented text:
+//
+//	.git/config:     [diff "loled"]
+//	                         textconv = loled diff -textconv
+//
+// (git runs the command with seven arguments, which is told apart from the
+// plain usage above).
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A difference found between two trees.
+type treeChange struct {
+	Kind string   `json:"kind"` // added, removed, renamed, moved, reordered, changed
+	Id   int      `json:"id"`
+	Path []string `json:"path"` // labels from below root, in the newer tree (older if removed)
+	// Depending on kind:
+	Was    string   `json:"was,omitempty"`    // renamed: former label
+	From   []string `json:"from,omitempty"`   // moved: former path
+	Fields []string `json:"fields,omitempty"` // changed: what did
+	Items  int      `json:"items,omitempty"`  // added, removed: number of items below it
+}
+
+// Returns labels of path down to 'n', excluding root.
+func pathLabels(n *node) []string {
+	labels := []string{}
+	for _, p := range n.ancestry()[1:] {
+		labels = append(labels, p.label)
+	}
+	return labels
+}
+
+// Returns ids that keep their order from 'a' to 'b' (one longest common
+// subsequence); the others count as reordered. Ids being unique, that is the
+// longest increasing subsequence of the positions in 'b' of ids in 'a'.
+func commonOrder(a, b []int) map[int]bool {
+	pos := make(map[int]int, len(b))
+	for j, id := range b {
+		pos[id] = j
+	}
+	// tails[k]: index in 'a' of the id ending the increasing subsequence of
+	// length k+1 found so far whose last position is least; prev: index of
+	// the id before each in its subsequence.
+	tails := []int{}
+	prev := make([]int, len(a))
+	for i, id := range a {
+		j, ok := pos[id]
+		if !ok {
+			continue
+		}
+		k := sort.Search(len(tails), func(k int) bool { return pos[a[tails[k]]] >= j })
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	common := make(map[int]bool, len(tails))
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+			common[a[i]] = true
+		}
+	}
+	return common
+}
+
+// Returns differences from tree 'a' to tree 'b'.
+func diffTrees(a, b fileTree) []treeChange {
+	olds, news := newMergeSide(a), newMergeSide(b)
+	changes := []treeChange{}
+
+	for _, n := range b.root.preorder() {
+		o := olds.nodes[n.id]
+		if n != b.root {
+			if o == nil {
+				if p := n.parent; p == b.root || olds.nodes[p.id] != nil {
+					changes = append(changes, treeChange{Kind: "added", Id: n.id,
+						Path: pathLabels(n), Items: len(n.preorder()) - 1})
+				}
+				continue
+			}
+			if o.label != n.label {
+				changes = append(changes, treeChange{Kind: "renamed", Id: n.id,
+					Path: pathLabels(n), Was: o.label})
+			}
+			if parentIdOf(o) != parentIdOf(n) {
+				changes = append(changes, treeChange{Kind: "moved", Id: n.id,
+					Path: pathLabels(n), From: pathLabels(o)})
+			}
+			fields := []string{}
+			for _, f := range mergeFields {
+				if f.name != "label" && f.get(o) != f.get(n) {
+					fields = append(fields, f.name)
+				}
+			}
+			if len(fields) > 0 {
+				changes = append(changes, treeChange{Kind: "changed", Id: n.id,
+					Path: pathLabels(n), Fields: fields})
+			}
+		}
+
+		// Kids on this list both before and after, which changed places
+		// among each other.
+		stayed := make(map[int]bool)
+		for _, kid := range n.sublist {
+			if k := olds.nodes[kid.id]; k != nil && parentIdOf(k) == n.id {
+				stayed[kid.id] = true
+			}
+		}
+		before, after := olds.kids(n.id, stayed), news.kids(n.id, stayed)
+		common := commonOrder(before, after)
+		for _, id := range after {
+			if !common[id] {
+				changes = append(changes, treeChange{Kind: "reordered", Id: id,
+					Path: pathLabels(news.nodes[id])})
+			}
+		}
+	}
+
+	for _, o := range a.root.preorder()[1:] {
+		if news.nodes[o.id] == nil {
+			if p := o.parent; p == a.root || news.nodes[p.id] != nil {
+				changes = append(changes, treeChange{Kind: "removed", Id: o.id,
+					Path: pathLabels(o), Items: len(o.preorder()) - 1})
+			}
+		}
+	}
+	return changes
+}
+
+// Writes out 'changes' for people to read.
+func writeChanges(w io.Writer, changes []treeChange) {
+	for _, c := range changes {
+		detail := ""
+		switch c.Kind {
+		case "added", "removed":
+			if c.Items > 0 {
+				detail = fmt.Sprintf(" (with %d item(s) below)", c.Items)
+			}
+		case "renamed":
+			detail = fmt.Sprintf(" (was %q)", c.Was)
+		case "moved":
+			detail = " (from " + strings.Join(c.From, sepCrumb) + ")"
+		case "changed":
+			detail = " (" + strings.Join(c.Fields, ", ") + ")"
+		}
+		fmt.Fprintf(w, "%-10s %s%s\n", c.Kind+":", strings.Join(c.Path, sepCrumb), detail)
+	}
+}
+
+// Writes out tree 't' as indented text, one item per line, with dates etc.
+// after the label and notes below it; for line based diffs.
+func writeTextconv(w io.Writer, t fileTree) {
+	var write func(nodes []*node, depth int)
+	write = func(nodes []*node, depth int) {
+		indent := strings.Repeat("\t", depth)
+		for _, n := range nodes {
+			line := indent + n.label
+			if n.priority != 0 {
+				line += " (" + priorityLetter(n.priority) + ")"
+			}
+			if dates := formatDateTokens(n); dates != "" {
+				line += " " + dates
+			}
+			if n.link != nil {
+				line += " -> " + strings.Join(pathLabels(n.link), sepCrumb)
+			}
+			if n.query != "" {
+				line += " query:" + n.query
+			}
+			if n.mount != nil {
+				line += " mount:" + n.mount.path
+			}
+			fmt.Fprintln(w, line)
+			if n.note != "" {
+				for _, l := range strings.Split(n.note, "\n") {
+					fmt.Fprintln(w, indent+"\t| "+l)
+				}
+			}
+			write(n.sublist, depth+1)
+		}
+	}
+	write(t.root.sublist, 0)
+}
+
+func readTree(path string) (fileTree, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fileTree{}, err
+	}
+	if strings.Trim(string(data), whitespace) == "" {
+		// E.g., git's stand-in for a file not there.
+		return fileTree{root: newNode("root")}, nil
+	}
+	t, err := parseTree(data)
+	if err != nil {
+		return t, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// Runs "loled diff" with (the rest of) command line 'args'. Returns exit
+// status.
+func diffMain(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "Output JSON.")
+	textconv := fs.Bool("textconv", false, "Just write out FILE as indented text.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [-json] OLD NEW\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s diff -textconv FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	paths := fs.Args()
+	gitDiff := false
+	switch {
+	case *textconv && len(paths) == 1:
+	case len(paths) == 2:
+	case len(paths) == 7:
+		// Run by git: PATH OLD-FILE OLD-HEX OLD-MODE NEW-FILE NEW-HEX
+		// NEW-MODE.
+		fmt.Printf("loled diff %s\n", paths[0])
+		paths = []string{paths[1], paths[4]}
+		gitDiff = true
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	trees := make([]fileTree, len(paths))
+	for i, path := range paths {
+		var err error
+		if trees[i], err = readTree(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	if *textconv {
+		writeTextconv(os.Stdout, trees[0])
+		return 0
+	}
+	changes := diffTrees(trees[0], trees[1])
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(changes); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		writeChanges(os.Stdout, changes)
+	}
+	// git takes any failure status of its diff command for trouble.
+	if len(changes) > 0 && !gitDiff {
+		return 1
+	}
+	return 0
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns 'c' in short, as "KIND ID" and what else it has to tell.
+func changeSummary(c treeChange) string {
+	s := fmt.Sprintf("%s %d", c.Kind, c.Id)
+	switch c.Kind {
+	case "added", "removed":
+		s += fmt.Sprintf(" (%d)", c.Items)
+	case "renamed":
+		s += " was " + c.Was
+	case "moved":
+		s += " from /" + strings.Join(c.From, "/")
+	case "changed":
+		s += " " + strings.Join(c.Fields, ",")
+	}
+	return s
+}
+
+func TestDiffTrees(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		// Applied to the tree made from 'b', for what specs cannot say.
+		edit func(b fileTree)
+		want []string
+	}{
+		{"same", "2 a\n3 b", "2 a\n3 b", nil,
+			[]string{}},
+		{"added", "2 a", "2 a\n3 b\n\t4 c", nil,
+			[]string{"added 3 (1)"}},
+		{"removed", "2 a\n\t3 b\n\t\t4 c", "2 a", nil,
+			[]string{"removed 3 (1)"}},
+		{"renamed", "2 a", "2 A", nil,
+			[]string{"renamed 2 was a"}},
+		{"moved", "2 a\n3 b", "2 a\n\t3 b", nil,
+			[]string{"moved 3 from /b"}},
+		{"reordered", "2 a\n3 b\n4 c", "3 b\n4 c\n2 a", nil,
+			[]string{"reordered 2"}},
+		{"changed", "2 a", "2 a",
+			func(b fileTree) {
+				n := b.root.sublist[0]
+				n.note = "note"
+				n.priority = 1
+			},
+			[]string{"changed 2 note,priority"}},
+		{"renamed and moved", "2 a\n3 b", "2 a\n\t3 B", nil,
+			[]string{"renamed 3 was b", "moved 3 from /b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := specTree(t, tt.a), specTree(t, tt.b)
+			if tt.edit != nil {
+				tt.edit(b)
+			}
+			got := []string{}
+			for _, c := range diffTrees(a, b) {
+				got = append(got, changeSummary(c))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommonOrder(t *testing.T) {
+	tests := []struct {
+		a, b []int
+		want int
+	}{
+		{[]int{}, []int{}, 0},
+		{[]int{1, 2, 3}, []int{1, 2, 3}, 3},
+		{[]int{1, 2, 3}, []int{3, 2, 1}, 1},
+		{[]int{1, 2, 3, 4}, []int{2, 3, 4, 1}, 3},
+		{[]int{1, 2, 3}, []int{2, 4}, 1},
+	}
+	for _, tt := range tests {
+		common := commonOrder(tt.a, tt.b)
+		if len(common) != tt.want {
+			t.Errorf("commonOrder(%v, %v) = %v, want %d ids", tt.a, tt.b, common, tt.want)
+		}
+		// What is kept must be in the same order on both.
+		last := -1
+		for _, id := range tt.b {
+			if !common[id] {
+				continue
+			}
+			for i, aid := range tt.a {
+				if aid == id {
+					if i < last {
+						t.Errorf("commonOrder(%v, %v) = %v, out of order", tt.a, tt.b, common)
+					}
+					last = i
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+// History of saved versions of the file, kept as commits in a git repository
+// of its own next to the file (so as not to mix with any repository the file
+// itself may be in). Needs git on PATH.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HISTORY_TIME_FORMAT = "2006-01-02 15:04:05"
+
+// A saved version of the file.
+type version struct {
+	hash    string
+	when    time.Time
+	subject string
+}
+
+// Returns directory of the history repository of the file.
+func (ds *dataStore) historyDir() string {
+	dir, base := filepath.Split(ds.filename)
+	return filepath.Join(dir, "."+base+".history")
+}
+
+// Runs git with 'args' in the history repository, returning its output.
+func (ds *dataStore) historyGit(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", ds.historyDir()}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v %s", strings.Join(args, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Records tree 't', as just saved, as the newest version in history. Does
+// nothing if it is the same as the newest version already.
+func (ds *dataStore) recordHistory(t fileTree) error {
+	dir := ds.historyDir()
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if _, err := ds.historyGit("init", "-q"); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.write(&buf); err != nil {
+		return err
+	}
+	base := filepath.Base(ds.filename)
+	if err := ioutil.WriteFile(filepath.Join(dir, base), buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if _, err := ds.historyGit("add", "--", base); err != nil {
+		return err
+	}
+	if _, err := ds.historyGit("diff", "--cached", "--quiet"); err == nil {
+		// Unchanged.
+		return nil
+	}
+	// The repository is private to loled, so it commits under its own
+	// name rather than relying on the user's git setup.
+	_, err := ds.historyGit("-c", "user.name=loled", "-c", "user.email=loled@localhost",
+		"commit", "-q", "-m", "Saved "+time.Now().Format(HISTORY_TIME_FORMAT))
+	return err
+}
+
+// Returns versions in history, newest first.
+func (ds *dataStore) historyVersions() ([]version, error) {
+	if _, err := os.Stat(ds.historyDir()); err != nil {
+		return nil, fmt.Errorf("no history kept for %q (see -H)", ds.filename)
+	}
+	out, err := ds.historyGit("log", "--format=%H %ct %s")
+	if err != nil {
+		return nil, err
+	}
+	versions := []version{}
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(l, " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad git log line %q", l)
+		}
+		versions = append(versions, version{fields[0], time.Unix(secs, 0), fields[2]})
+	}
+	return versions, nil
+}
+
+// Returns the tree as saved in version 'hash'.
+func (ds *dataStore) historyTree(hash string) (fileTree, error) {
+	out, err := ds.historyGit("show", hash+":"+filepath.Base(ds.filename))
+	if err != nil {
+		return fileTree{}, err
+	}
+	return parseTree([]byte(out))
+}
+
+// Shows versions in history, newest first. Entering one previews it.
+func (ds *dataStore) showHistory() {
+	versions, err := ds.historyVersions()
+	if err != nil {
+		Log("History not available: %v.", err)
+		return
+	}
+
+	// Stand-ins for versions; they are not part of the tree.
+	items := []*node{}
+	hashes := make(map[*node]string)
+	for _, v := range versions {
+		n := newNode(v.when.Format(HISTORY_TIME_FORMAT))
+		items = append(items, n)
+		hashes[n] = v.hash
+	}
+	ds.enterView("[history]", items, nil)
+	ds.currentList.view.open = func(n *node) {
+		t, err := ds.historyTree(hashes[n])
+		if err != nil {
+			Log("Cannot read version: %v.", err)
+			return
+		}
+		ds.enterPreview("["+n.label+"]", t.root)
+	}
+}
+
+// Shows items of 'n', from an old version, without letting them be changed.
+// Entering an item previews its sublist in turn.
+func (ds *dataStore) enterPreview(label string, n *node) {
+	ds.enterView(label, append([]*node{}, n.sublist...), nil)
+	ds.currentList.view.readOnly = true
+	ds.currentList.view.open = func(kid *node) {
+		ds.enterPreview(kid.resolve().label, kid.resolve())
+	}
+}
+
+// Copies current item of a preview, along with everything below it, to
+// Target 't'. Undoable.
+func (ds *dataStore) restoreToTarget(t *Target) {
+	if ds.currentItem == nil {
+		return
+	}
+	if t.list == nil {
+		Log("Target not set.")
+		return
+	}
+	c := ds.currentItem.copyTree()
+
+	// Links in the copy point into the old version. Point them at the same
+	// items as they are now, if still around; otherwise make them copies
+	// of what they linked to.
+	current := make(map[int]*node)
+	for _, n := range ds.root.preorder() {
+		current[n.id] = n
+	}
+	for _, n := range c.preorder() {
+		if n.link == nil {
+			continue
+		}
+		if m, ok := current[n.link.id]; ok {
+			n.link = m.resolve()
+		} else {
+			n.copyContent(n.link.resolve())
+			n.link = nil
+		}
+	}
+
+	ds.saveUndo("restore", t.list)
+	t.insert(c)
+	ds.dirty = true
+	Log("Restored %q to Target.", c.label)
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,238 @@
+package main
+
+// Indexes of the tree of a buffer: items by id, and how many links and
+// references there are to each. Kept up to date as items are added, removed
+// or changed, so that showing items takes no walks over the whole tree. As
+// with searches, items of files mounted are left out.
+
+import "strings"
+
+// Fewest items in a tree for its Analyze() to be kept; smaller ones are
+// quick enough to count anew.
+const INDEX_ANALYZE_MIN = 1000
+
+type treeIndex struct {
+	// Root of the tree indexed; the index is of no other.
+	root *node
+	// Ids being unique, also tells which items are in the index.
+	byId map[int]*node
+	// Number of links to each item.
+	links map[*node]int
+	// Number of items referring to each id, by [[id:N]].
+	idRefs map[int]int
+	// Items referring to others by path. They are few, so are resolved
+	// only when asked.
+	pathRefs map[*node]bool
+	// Results of Analyze() of items with large trees below them; dropped on
+	// any change.
+	analyzed map[*node][2]int
+}
+
+func newTreeIndex(root *node) *treeIndex {
+	x := &treeIndex{
+		root:     root,
+		byId:     make(map[int]*node),
+		links:    make(map[*node]int),
+		idRefs:   make(map[int]int),
+		pathRefs: make(map[*node]bool),
+	}
+	x.addTree(root)
+	return x
+}
+
+// Returns ids referred to by 'n' (each once), and whether it refers to any
+// items by path.
+func refsOf(n *node) ([]int, bool) {
+	ids := []int{}
+	byPath := false
+	for _, ref := range itemRefs(n) {
+		if !strings.HasPrefix(ref, REF_PREFIX_ID) {
+			byPath = true
+			continue
+		}
+		id, ok := parseIdRef(ref)
+		if !ok {
+			continue
+		}
+		seen := false
+		for _, other := range ids {
+			seen = seen || other == id
+		}
+		if !seen {
+			ids = append(ids, id)
+		}
+	}
+	return ids, byPath
+}
+
+// Adds 'n' itself (not the items below it), unless there already.
+func (x *treeIndex) add(n *node) {
+	if x == nil || x.byId[n.id] == n {
+		return
+	}
+	x.byId[n.id] = n
+	if n.link != nil {
+		x.links[n.link]++
+	}
+	ids, byPath := refsOf(n)
+	for _, id := range ids {
+		x.idRefs[id]++
+	}
+	if byPath {
+		x.pathRefs[n] = true
+	}
+	x.analyzed = nil
+}
+
+// Removes 'n' itself (not the items below it), if there.
+func (x *treeIndex) remove(n *node) {
+	if x == nil || x.byId[n.id] != n {
+		return
+	}
+	delete(x.byId, n.id)
+	if n.link != nil {
+		if x.links[n.link]--; x.links[n.link] <= 0 {
+			delete(x.links, n.link)
+		}
+	}
+	ids, _ := refsOf(n)
+	for _, id := range ids {
+		if x.idRefs[id]--; x.idRefs[id] <= 0 {
+			delete(x.idRefs, id)
+		}
+	}
+	delete(x.pathRefs, n)
+	x.analyzed = nil
+}
+
+// Adds 'n' and the items below it.
+func (x *treeIndex) addTree(n *node) {
+	if x == nil || n.enter != nil {
+		return
+	}
+	for _, m := range n.preorder() {
+		x.add(m)
+	}
+}
+
+// Removes 'n' and the items below it.
+func (x *treeIndex) removeTree(n *node) {
+	if x == nil || n.enter != nil {
+		return
+	}
+	for _, m := range n.preorder() {
+		x.remove(m)
+	}
+}
+
+// Returns the index (if any) of the tree list 'l' is on. There is none for
+// views, nor for lists of files mounted.
+func indexFor(l *node) *treeIndex {
+	for p := l; p != nil; p = p.parent {
+		if p.view != nil || p.mount != nil {
+			return nil
+		}
+		if p.parent == nil {
+			return indexOfRoot(p)
+		}
+	}
+	return nil
+}
+
+// Returns the index of the tree at 'root', if any.
+func indexOfRoot(root *node) *treeIndex {
+	if ds != nil && ds.index != nil && ds.index.root == root {
+		return ds.index
+	}
+	for _, b := range buffers {
+		if b.index != nil && b.index.root == root {
+			return b.index
+		}
+	}
+	return nil
+}
+
+// Drops results of Analyze() kept for the items above mount item 'm', as
+// those count the items of the file mounted, which changed.
+func mountChanged(m *node) {
+	top := m
+	for top.parent != nil {
+		top = top.parent
+	}
+	if x := indexOfRoot(top); x != nil {
+		x.analyzed = nil
+	}
+}
+
+// Changes item 'n' (its label, note or what it links to; not its place or
+// sublist) by calling 'change', keeping the index up to date.
+func changeItem(n *node, change func()) {
+	x := indexFor(n.parent)
+	if x == nil || x.byId[n.id] != n {
+		change()
+		return
+	}
+	x.remove(n)
+	change()
+	x.add(n)
+}
+
+// Returns the index of the tree, (re)built if need be.
+func (ds *dataStore) freshIndex() *treeIndex {
+	if ds.index == nil || ds.index.root != ds.root {
+		ds.index = newTreeIndex(ds.root)
+	}
+	return ds.index
+}
+
+// Has the index rebuilt, for changes too sweeping to follow item by item.
+func (ds *dataStore) reindex() {
+	ds.index = nil
+}
+
+// Returns the item with id 'id', or nil if none.
+func (ds *dataStore) nodeById(id int) *node {
+	return ds.freshIndex().byId[id]
+}
+
+// Returns the number of links to 'n'.
+func (ds *dataStore) linkCount(n *node) int {
+	return ds.freshIndex().links[n]
+}
+
+// Returns the number of items referring to 'n'; as many as backlinks()
+// returns.
+func (ds *dataStore) backlinkCount(n *node) int {
+	n = n.resolve()
+	x := ds.freshIndex()
+	count := x.idRefs[n.id]
+	for m := range x.pathRefs {
+		ids, _ := refsOf(m)
+		counted := false
+		for _, id := range ids {
+			counted = counted || id == n.id
+		}
+		if !counted && ds.refersByPath(m, n) {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns n.Analyze(), from the index if there.
+func (ds *dataStore) analyze(n *node) (int, int) {
+	x := ds.freshIndex()
+	if a, ok := x.analyzed[n]; ok {
+		return a[0], a[1]
+	}
+	count, depth := n.Analyze()
+	if count >= INDEX_ANALYZE_MIN && x.byId[n.id] == n {
+		if x.analyzed == nil {
+			x.analyzed = make(map[*node][2]int)
+		}
+		x.analyzed[n] = [2]int{count, depth}
+	}
+	return count, depth
+}
+
+// vim: fdm=syntax
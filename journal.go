@@ -0,0 +1,138 @@
+package main
+
+// Crash recovery: while there are unsaved changes, the tree is written every
+// so often to a journal file next to the file (encrypted, if the file is),
+// much like Vim's swap file. It is removed on saving, on dropping the changes
+// and on quitting cleanly, so one found on startup, newer than the file, holds
+// changes lost to a crash; the user gets to recover or discard them. Files
+// mounted are not covered.
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Journal is written at most this many times as seldom as it takes to write,
+// so that with large trees it does not keep the editor busy.
+const JOURNAL_COST_FACTOR = 10
+
+// What is known of the journal file.
+type journalState struct {
+	// Tree as last written by us (before any encryption); nil if we have
+	// not, and so do not own any journal there may be.
+	data []byte
+	// Set while a journal left over from before has not been dealt with.
+	// Meanwhile no journal is written, so as not to overwrite it.
+	found time.Time
+	// Whether user has been asked about it.
+	asked bool
+	// Not to be written again before then; see JOURNAL_COST_FACTOR.
+	next time.Time
+}
+
+// Returns path of the journal file of the file.
+func (ds *dataStore) journalPath() string {
+	dir, base := filepath.Split(ds.filename)
+	return filepath.Join(dir, "."+base+".journal")
+}
+
+// Looks for a journal left over from before, as on opening the file. One
+// older than the file is of no use, and removed.
+func (ds *dataStore) findJournal() {
+	if ds.readOnly {
+		// Perhaps that of whoever holds the lock.
+		return
+	}
+	jfi, err := os.Stat(ds.journalPath())
+	if err != nil {
+		return
+	}
+	if fi, err := os.Stat(ds.filename); err == nil && !jfi.ModTime().After(fi.ModTime()) {
+		os.Remove(ds.journalPath())
+		return
+	}
+	ds.journal.found = jfi.ModTime()
+	Log("Found unsaved changes to %q, from %s.", ds.filename,
+		ds.journal.found.Format(HISTORY_TIME_FORMAT))
+}
+
+// Replaces tree with that in the journal left over from before, as unsaved
+// changes.
+func (ds *dataStore) recoverJournal() error {
+	data, err := ioutil.ReadFile(ds.journalPath())
+	if err != nil {
+		return err
+	}
+	plain, err := ds.decrypt(data)
+	if err != nil {
+		return err
+	}
+	t, err := parseTree(plain)
+	if err != nil {
+		return err
+	}
+	reserveNodeId(t.lastId)
+	ds.setTree(t)
+	ds.undo = nil
+	ds.linkTrail = nil
+	ds.journal = journalState{data: plain}
+	ds.dirty = true
+	Log("Recovered unsaved changes to %q; S to save them.", ds.filename)
+	return nil
+}
+
+// Removes the journal left over from before, changes and all.
+func (ds *dataStore) discardJournal() {
+	os.Remove(ds.journalPath())
+	ds.journal = journalState{}
+}
+
+// Writes the tree to the journal, if there are unsaved changes not there yet.
+func (ds *dataStore) writeJournal() {
+	if !ds.dirty || ds.readOnly || ds.sealed != nil || !ds.journal.found.IsZero() {
+		return
+	}
+	if time.Now().Before(ds.journal.next) {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		ds.journal.next = time.Now().Add(JOURNAL_COST_FACTOR * time.Since(start))
+	}()
+	var buf bytes.Buffer
+	if err := ds.tree().write(&buf); err != nil {
+		Log("Unable to write journal of %q: %v.", ds.filename, err)
+		return
+	}
+	plain := buf.Bytes()
+	if bytes.Equal(plain, ds.journal.data) {
+		return
+	}
+	data := plain
+	if ds.crypt != nil {
+		var err error
+		if data, err = ds.crypt.seal(plain); err != nil {
+			Log("Unable to write journal of %q: %v.", ds.filename, err)
+			return
+		}
+	}
+	if err := writeFileAtomic(ds.journalPath(), data, 0600); err != nil {
+		Log("Unable to write journal of %q: %v.", ds.filename, err)
+		return
+	}
+	ds.journal.data = plain
+}
+
+// Removes the journal, if ours; for when there are no unsaved changes (left)
+// to recover.
+func (ds *dataStore) removeJournal() {
+	if ds.journal.data != nil {
+		os.Remove(ds.journalPath())
+		ds.journal.data = nil
+	}
+}
+
+// vim: fdm=syntax
@@ -14,7 +14,14 @@ type dialogCallback func([]string)
 
 type LineEditor struct {
 	multiline bool
-	onFinish  dialogCallback
+	// Multi-line entry, where even blank lines are part of the text (so
+	// Ctrl-S is what finishes entry).
+	freeform bool
+	// Entry not to be shown (e.g., a passphrase): kept here, while the view
+	// shows just as many '*'.
+	secret   bool
+	hidden   []rune
+	onFinish dialogCallback
 }
 
 // A beefed up version of 'simpleEditor' that resembles Emacs-like bindings
@@ -72,6 +79,11 @@ func fullerEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 			x -= 1
 			v.EditDelete(true)
 		}
+	case key == gocui.KeyCtrlY:
+		// paste
+		for _, r := range vd.clipboard {
+			v.EditWrite(r)
+		}
 	default:
 		// If we didn't handle key above, pass through to base editor.
 		gocui.DefaultEditor.Edit(v, key, ch, mod)
@@ -93,13 +105,40 @@ func fullerEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 
 func (le *LineEditor) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 	onDone := func() {
-		le.onFinish(v.BufferLines())
+		if le.secret {
+			le.onFinish([]string{string(le.hidden)})
+			for i := range le.hidden {
+				le.hidden[i] = 0
+			}
+			le.hidden = nil
+		} else {
+			le.onFinish(v.BufferLines())
+		}
 		vd.gui.Cursor = false
 		vd.gui.DeleteView("dialog")
 		vd.gui.SetCurrentView("main")
 	}
 
 	switch {
+	case le.secret && key == gocui.KeyEnter:
+		onDone()
+	case le.secret && (key == gocui.KeyBackspace || key == gocui.KeyBackspace2):
+		if len(le.hidden) > 0 {
+			le.hidden = le.hidden[:len(le.hidden)-1]
+			v.EditDelete(true)
+		}
+	case le.secret && (ch != 0 || key == gocui.KeySpace):
+		if key == gocui.KeySpace {
+			ch = ' '
+		}
+		le.hidden = append(le.hidden, ch)
+		v.EditWrite('*')
+	case le.secret:
+		// Editing keys would get the view and entry out of step.
+	case key == gocui.KeyCtrlS && le.freeform:
+		onDone()
+	case key == gocui.KeyEnter && le.freeform:
+		fullerEditor(v, key, ch, mod)
 	case key == gocui.KeyEnter && !le.multiline:
 		onDone()
 	case key == gocui.KeyEnter && le.multiline:
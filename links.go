@@ -0,0 +1,109 @@
+package main
+
+// Links let one item show up on several lists at once. A link is a node of its
+// own, placed on a list like any other, but it stands in for the item it links
+// to: label, note, dates, sublist etc. shown and edited are those of that item.
+// Moving, completing or trashing a link affects just that one appearance of
+// the item; only once the item itself is expunged does one of its links take
+// over as the item.
+
+// Returns the node whose content 'n' shows: what it links to, else n itself.
+func (n *node) resolve() *node {
+	for n.link != nil {
+		n = n.link
+	}
+	return n
+}
+
+// Returns a new link to 'n' (or to what n links to).
+func newLink(n *node) *node {
+	l := newNode("")
+	l.link = n.resolve()
+	return l
+}
+
+// Places a link to the current item at Target 't', like
+// MoveCurrentItemToTarget() would the item itself.
+func (ds *dataStore) LinkCurrentItemAtTarget(t *Target) {
+	if ds.currentItem == nil {
+		Log("No current item.")
+		return
+	}
+	if ds.currentItem.parent == nil || ds.currentItem.enter != nil {
+		Log("Not an item of the tree.")
+		return
+	}
+	if t.list == nil {
+		Log("Target not set.")
+		return
+	}
+	if b := ds.otherFile(t.list); b != nil {
+		// Links do not reach across files; copy instead.
+		if c := ds.copyToBuffer(b, t); c != nil {
+			Log("Copied %q to %q.", c.label, b.fileOf(t.list))
+		}
+		return
+	}
+	t.insert(newLink(ds.currentItem))
+	ds.forgetUndo()
+	ds.dirty = true
+}
+
+// Makes link 'l' take over as the item it links to: the content of that item
+// moves over to l, leaving it an empty husk.
+func (l *node) adopt() {
+	t := l.link
+	l.copyContent(t)
+	l.id = t.id
+	l.mount, t.mount = t.mount, nil
+	kids := t.sublist
+	t.sublist = []*node{}
+	for _, kid := range kids {
+		l.insertKid(len(l.sublist), kid)
+	}
+}
+
+// Readies items in Trash 'trash' of the tree at 'root' to be expunged: any of
+// them still linked to from outside of Trash is taken over by the first such
+// link, and remaining links are pointed at that one instead.
+func (ds *dataStore) promoteLinks(root, trash *node) {
+	// Taking over an item brings its sublist out of Trash, possibly with
+	// more links in it; so repeat until nothing changes.
+	for promoted := true; promoted; {
+		promoted = false
+		kept := []*node{}
+		var walk func(n *node)
+		walk = func(n *node) {
+			kept = append(kept, n)
+			for _, kid := range n.sublist {
+				if kid != trash {
+					walk(kid)
+				}
+			}
+		}
+		walk(root)
+		isKept := make(map[*node]bool)
+		for _, n := range kept {
+			isKept[n] = true
+		}
+
+		heirs := make(map[*node]*node)
+		for _, n := range kept {
+			if n.link == nil || isKept[n.link] {
+				continue
+			}
+			if heir, ok := heirs[n.link]; ok {
+				n.link = heir
+				continue
+			}
+			heirs[n.link] = n
+			if ds.Mark.list == n.link {
+				ds.Mark.list = n
+			}
+			n.adopt()
+			promoted = true
+		}
+	}
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestLinkVirtualItemRefused(t *testing.T) {
+	b := testBuffer(t, "a #tag")
+	b.SetUserTarget()
+	b.showTags()
+	if len(b.currentList.sublist) == 0 {
+		t.Fatal("no tags shown")
+	}
+	b.setCurrentItemUsingIndex(0)
+	b.LinkCurrentItemAtTarget(b.Mark)
+	for _, n := range b.root.preorder() {
+		if n.link != nil {
+			t.Fatalf("link to %q placed", n.link.label)
+		}
+	}
+}
+
+func TestLinkToItemNotInTree(t *testing.T) {
+	b := testBuffer(t, "a")
+	b.SetUserTarget()
+	b.LinkCurrentItemAtTarget(b.Mark)
+	// Item linked to is taken out of the tree, its link left behind.
+	b.root.removeKid(b.root.indexOf(b.currentItem))
+
+	tree := testReload(t, b)
+	for _, n := range tree.root.preorder() {
+		if n.link != nil {
+			t.Errorf("link to %q loaded", n.link.label)
+		}
+		if n.label == "a" {
+			return
+		}
+	}
+	t.Error("link not saved as a plain item")
+}
+
+func TestParseLinkToMissingNode(t *testing.T) {
+	data := "DONE 2\nTRASH 3\n" +
+		"node 1\nroot\n2 3 4\n" +
+		"node 2\n[[DONE]]\n\n" +
+		"node 3\n[[TRASH]]\n\n" +
+		"node 4\n\n\n" +
+		"LINK 4 \"9\"\n"
+	tree, err := parseTree([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := tree.root.sublist[2]
+	if n.link != nil || n.label == "" {
+		t.Errorf("link to missing node loaded as %q, link %v", n.label, n.link)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+// Locking of the file, so that two loled's do not edit it at once (and the
+// last to save silently wins). The lock is a file of its own next to the
+// file, saying which process on which host holds it. Locks left behind by
+// processes since gone are taken over, where that can be told; otherwise the
+// user decides.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Who holds a lock.
+type lockOwner struct {
+	pid  int
+	host string
+}
+
+func (o lockOwner) String() string {
+	return fmt.Sprintf("process %d on %s", o.pid, o.host)
+}
+
+func thisLockOwner() lockOwner {
+	host, _ := os.Hostname()
+	return lockOwner{os.Getpid(), host}
+}
+
+// Returns path of the lock file of the file.
+func (ds *dataStore) lockPath() string {
+	dir, base := filepath.Split(ds.filename)
+	return filepath.Join(dir, "."+base+".lock")
+}
+
+// Returns who holds the lock, or an error if nobody does (or it cannot be
+// told).
+func (ds *dataStore) readLock() (lockOwner, error) {
+	var o lockOwner
+	data, err := ioutil.ReadFile(ds.lockPath())
+	if err != nil {
+		return o, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return o, fmt.Errorf("bad lock file %q", ds.lockPath())
+	}
+	if o.pid, err = strconv.Atoi(fields[0]); err != nil {
+		return o, fmt.Errorf("bad lock file %q", ds.lockPath())
+	}
+	o.host = fields[1]
+	return o, nil
+}
+
+// Whether lock held by 'o' is left over from a process no longer running.
+// Only known for processes on this host.
+func (o lockOwner) stale() bool {
+	if o.host != thisLockOwner().host {
+		return false
+	}
+	// Signal 0 checks for the process without disturbing it; EPERM means
+	// it is there, but someone else's.
+	return syscall.Kill(o.pid, 0) == syscall.ESRCH
+}
+
+// Takes the lock, unless someone holds it already. Returns os.ErrExist if so.
+// The lock file is written aside and linked into place, so that it is never
+// seen empty or half written.
+func (ds *dataStore) takeLock() error {
+	o := thisLockOwner()
+	tmp := ds.lockPath() + "." + o.host + "." + strconv.Itoa(o.pid)
+	data := fmt.Sprintf("%d %s\n", o.pid, o.host)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, ds.lockPath()); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return os.ErrExist
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns path of the file held while breaking a stale lock.
+func (ds *dataStore) breakPath() string {
+	return ds.lockPath() + ".break"
+}
+
+// Removes the lock held by 'o', which is stale. One process at a time does
+// so, and only if the lock is still o's: else two taking over the same stale
+// lock could each remove the one the other just took. Returns os.ErrExist if
+// another process is breaking it just now.
+func (ds *dataStore) breakLock(o lockOwner) error {
+	f, err := os.OpenFile(ds.breakPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return os.ErrExist
+		}
+		return err
+	}
+	f.Close()
+	defer os.Remove(ds.breakPath())
+	if cur, err := ds.readLock(); err == nil && cur == o {
+		return os.Remove(ds.lockPath())
+	}
+	return nil
+}
+
+// Whether we hold the lock.
+func (ds *dataStore) holdsLock() bool {
+	o, err := ds.readLock()
+	return err == nil && o == thisLockOwner()
+}
+
+// Gives up the lock, if we hold it.
+func (ds *dataStore) releaseLock() {
+	if ds.holdsLock() {
+		os.Remove(ds.lockPath())
+	}
+}
+
+// Takes the lock, taking it over if stale. Returns os.ErrExist if somebody
+// else holds it, and who, if that can be told.
+func (ds *dataStore) tryLock() (*lockOwner, error) {
+	for {
+		err := ds.takeLock()
+		if err != os.ErrExist {
+			return nil, err
+		}
+		o, err := ds.readLock()
+		if err != nil {
+			// Being written just now, perhaps; or garbage.
+			return nil, os.ErrExist
+		}
+		if !o.stale() {
+			return &o, os.ErrExist
+		}
+		Log("Taking over lock on %q from %v, which is gone.", ds.filename, o)
+		if err := ds.breakLock(o); err != nil {
+			return &o, err
+		}
+	}
+}
+
+// Switches read-only mode; before allowing changes, takes the lock (if not
+// held already, e.g. when started read-only).
+func (ds *dataStore) toggleReadOnly() {
+	if !ds.readOnly {
+		// Changes not saved would be dropped on quitting, unasked.
+		if ds.dirty {
+			Log("Unsaved changes; save them before making %q read-only.", ds.filename)
+			return
+		}
+		ds.readOnly = true
+		Log("Read-only.")
+		return
+	}
+	if !ds.holdsLock() {
+		if o, err := ds.tryLock(); o != nil {
+			Log("%q is locked by %v; still read-only.", ds.filename, o)
+			return
+		} else if err != nil {
+			Log("Unable to lock %q: %v; still read-only.", ds.filename, err)
+			return
+		}
+	}
+	ds.readOnly = false
+	Log("Changes allowed.")
+}
+
+// Returned by lockOrAsk() when user chose to quit.
+var errQuitLocked = errors.New("locked; quitting")
+
+// Locks the file for editing, on startup. If somebody else has it locked,
+// asks user whether to go on read-only, break the lock, or quit. Returns
+// whether to go on read-only; errQuitLocked to quit.
+func (ds *dataStore) lockOrAsk() (bool, error) {
+	for {
+		o, err := ds.tryLock()
+		if err == nil {
+			return false, nil
+		}
+		if err != os.ErrExist {
+			fmt.Printf("Unable to lock %q: %v; going on read-only.\n", ds.filename, err)
+			return true, nil
+		}
+		if o != nil {
+			fmt.Printf("%q is locked by %v.\n", ds.filename, o)
+		} else {
+			fmt.Printf("%q is locked, by whom cannot be told.\n", ds.filename)
+		}
+		fmt.Printf("Open it [r]ead-only, [b]reak the lock (if sure it is not in use), or [q]uit? ")
+		switch strings.ToLower(strings.TrimSpace(readString())) {
+		case "r":
+			return true, nil
+		case "b":
+			os.Remove(ds.lockPath())
+			os.Remove(ds.breakPath())
+		default:
+			return false, errQuitLocked
+		}
+	}
+}
+
+// vim: fdm=syntax
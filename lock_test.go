@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnlyRefusedWhenDirty(t *testing.T) {
+	b := testBuffer(t, "a")
+	b.toggleReadOnly()
+	if b.readOnly {
+		t.Error("made read-only with unsaved changes")
+	}
+	b.dirty = false
+	b.toggleReadOnly()
+	if !b.readOnly {
+		t.Error("not made read-only once saved")
+	}
+}
+
+func TestStaleLockTakenOver(t *testing.T) {
+	b := &dataStore{filename: t.TempDir() + "/test.lol"}
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Skip(err)
+	}
+	stale := lockOwner{gone.Process.Pid, thisLockOwner().host}
+	data := fmt.Sprintf("%d %s\n", stale.pid, stale.host)
+	if err := ioutil.WriteFile(b.lockPath(), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the lock of the owner found stale is removed.
+	if err := b.breakLock(thisLockOwner()); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := b.readLock(); err != nil || o != stale {
+		t.Fatalf("lock of %v removed", stale)
+	}
+
+	if o, err := b.tryLock(); err != nil {
+		t.Fatalf("not taken over from %v: %v", o, err)
+	}
+	if !b.holdsLock() {
+		t.Error("lock not held")
+	}
+	if err := b.takeLock(); err != os.ErrExist {
+		t.Errorf("taken twice: %v", err)
+	}
+	files, _ := filepath.Glob(b.lockPath() + ".*")
+	if len(files) != 0 {
+		t.Errorf("left behind: %q", files)
+	}
+}
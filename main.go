@@ -8,6 +8,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -19,9 +20,13 @@ import (
 )
 
 var filename = flag.String("f", "./lol.txt",
-	"Filename to use for saving and loading.")
+	"Filename to use for saving and loading, unless files are given as arguments.")
 var backupSuffix = flag.String("b", "~",
 	"Suffix to append to filename for backups. Use empty string to turn off backups.")
+var keepHistory = flag.Bool("H", false,
+	"Keep history of saves, in a git repository next to the file.")
+var readOnly = flag.Bool("r", false,
+	"Read-only: browse the file, without changing it (or locking it).")
 
 var cmdPrompt = "$ "
 var whitespace = " 	\n\r"
@@ -39,11 +44,21 @@ var pfxItem = "- "
 var pfxFocusedItem = ">>"
 var pfxFocusedMovingItem = "▲▼"
 var sfxMore = " ▼"
+var sfxNote = " ✎"
+var sfxRepeat = " ↻"
+var sfxQuery = " ⌕"
+var sfxShared = " ⇄"
+var sfxMount = " ⊞"
+var sepCrumb = " › "
 
 const (
 	PANE_MAIN_MAX_WIDTH = 60
 	LABEL_TRASH         = "[[TRASH]]"
 	LABEL_DONE          = "[[DONE]]"
+	LABEL_RECENT        = "[[RECENT FILES]]"
+	// Start of the label of what stands in for a file mounted which could
+	// not be loaded.
+	LABEL_NOT_LOADED = "[[not loaded: "
 )
 
 // The "View" component of MVC framework.
@@ -65,11 +80,25 @@ type viewData struct {
 
 	// primary editor
 	editorLol *LolEditor
+
+	// Index of the first item shown of the current list; see
+	// updateMainPane().
+	mainFirst int
+
+	// To be run once GUI is torn down; see suspendGui().
+	onSuspend func()
+
+	// Text for pasting into dialogs (with Ctrl-Y), e.g. a reference to an
+	// item.
+	clipboard string
 }
 
+// Returned from main loop to have it tear down the GUI temporarily.
+var errSuspend = errors.New("GUI suspended")
+
 ////////////////////////////////////////
 // Singletons
-var ds dataStore
+var ds *dataStore // current buffer; see buffers.go
 var vd viewData
 
 ////////////////////////////////////////
@@ -83,6 +112,28 @@ func dialog(g *gocui.Gui, title, prefill string, multiline bool) *LineEditor {
 	} else {
 		h = 2
 	}
+	le := LineEditor{}
+	le.multiline = multiline
+	return dialogWithEditor(g, title, prefill, &le, w, h)
+}
+
+// A larger dialog, for free-form text such as notes. Enter only ever starts
+// a new line; Ctrl-S finishes.
+func textDialog(g *gocui.Gui, title, prefill string) *LineEditor {
+	maxX, maxY := g.Size()
+	le := LineEditor{}
+	le.freeform = true
+	return dialogWithEditor(g, title, prefill, &le, min(70, maxX-2), min(15, maxY-2))
+}
+
+// A dialog for entering a secret, such as a passphrase, which is not shown.
+func secretDialog(g *gocui.Gui, title string) *LineEditor {
+	le := LineEditor{}
+	le.secret = true
+	return dialogWithEditor(g, title, "", &le, 40, 2)
+}
+
+func dialogWithEditor(g *gocui.Gui, title, prefill string, le *LineEditor, w, h int) *LineEditor {
 	maxX, maxY := g.Size()
 	if v, err := g.SetView("dialog", maxX/2-w/2, maxY/2-h/2, maxX/2+w/2, maxY/2-h/2+h); err != nil {
 		if err != gocui.ErrUnknownView {
@@ -90,19 +141,22 @@ func dialog(g *gocui.Gui, title, prefill string, multiline bool) *LineEditor {
 		}
 		v.Frame = true
 		v.Editable = true
-		le := LineEditor{}
-		le.multiline = multiline
-		v.Editor = &le
+		v.Editor = le
 		v.Title = title
-		fmt.Fprintf(v, prefill)
-		// TODO: what if prefill is multiline?
-		v.SetCursor(len(prefill), 0)
+		fmt.Fprint(v, prefill)
+		// Place cursor at end of prefill, scrolling down if it is taller
+		// than the dialog.
+		lines := strings.Split(prefill, "\n")
+		_, vh := v.Size()
+		oy := max(0, len(lines)-vh)
+		v.SetOrigin(0, oy)
+		v.SetCursor(runeLen(lines[len(lines)-1]), len(lines)-1-oy)
 		vd.paneDialog = v
 		g.Cursor = true
 		if _, err := g.SetCurrentView("dialog"); err != nil {
 			panic(err)
 		}
-		return &le
+		return le
 	}
 	return nil
 }
@@ -163,7 +217,9 @@ func layout(g *gocui.Gui) error {
 		}
 		v.Frame = true
 		v.Title = "Main"
-		vd.editorLol = &LolEditor{}
+		if vd.editorLol == nil {
+			vd.editorLol = &LolEditor{}
+		}
 		v.Editor = vd.editorLol
 		v.Editable = true
 		v.Highlight = false // to be toggled on once list has items
@@ -178,9 +234,7 @@ func layout(g *gocui.Gui) error {
 		vd.paneMain = v
 		updateMainPane()
 		g.SetCurrentView("main")
-		if len(ds.currentList.sublist) > 0 {
-			ds.setCurrentItemUsingIndex(0)
-		}
+		ds.setCurrentItemUsingIndex(ds.currentItemIndex())
 	}
 	if v, err := g.SetView("info", dimsInfo[0], dimsInfo[1], dimsInfo[2], dimsInfo[3]); err != nil {
 		if err != gocui.ErrUnknownView {
@@ -201,11 +255,16 @@ func layout(g *gocui.Gui) error {
 		v.Title = "Log"
 		v.Autoscroll = true
 		v.FgColor = 240
-		vd.paneMessage = v
 
-		fmt.Fprintln(v, logo)
-		fmt.Fprintln(v, "")
-		fmt.Fprintln(v, "Welcome.")
+		if vd.paneMessage != nil {
+			// GUI is being set up again; carry over earlier messages.
+			fmt.Fprint(v, vd.paneMessage.Buffer())
+		} else {
+			fmt.Fprintln(v, logo)
+			fmt.Fprintln(v, "")
+			fmt.Fprintln(v, "Welcome.")
+		}
+		vd.paneMessage = v
 	}
 	return nil
 }
@@ -219,18 +278,43 @@ func updateMainPane() {
 		panic("currentList not found!")
 	}
 
-	view_title := filepath.Base(*filename)
+	view_title := filepath.Base(ds.filename)
+	if len(buffers) > 1 {
+		view_title += fmt.Sprintf(" [%d/%d]", bufferIndex(ds)+1, len(buffers))
+	}
 	if ds.dirty {
 		view_title = "* " + view_title
 	}
+	if ds.readOnly {
+		view_title = "RO " + view_title
+	}
 	vd.paneMain.Title = view_title
 
-	list_title := fmt.Sprintf("▶ %v", n.label) // TODO: add more info
+	width, _ := vd.paneMain.Size()
+	list_title := breadcrumb(n, width)
 	fmt.Fprintln(vd.paneMain, list_title)
-	// NOTE: len() needs to count runes, not bytes (because of Unicode
-	// multibyte runes).
-	fmt.Fprintln(vd.paneMain, strings.Repeat("─", len([]rune(list_title))))
-	for _, kid := range n.sublist {
+	fmt.Fprintln(vd.paneMain, strings.Repeat("─", runeLen(list_title)))
+	now := today()
+
+	// Only items that fit are shown, scrolling to keep the current one in
+	// view; very long lists would take long to show in full.
+	_, height := vd.paneMain.Size()
+	rows := max(height-2, 1)
+	cur := -1
+	if ds.currentItem != nil {
+		cur = ds.indexOfItem(ds.currentItem)
+	}
+	first := vd.mainFirst
+	if cur >= 0 && cur < first {
+		first = cur
+	} else if cur >= first+rows {
+		first = cur - rows + 1
+	}
+	first = max(0, min(first, len(n.sublist)-rows))
+	vd.mainFirst = first
+
+	for i := first; i < min(len(n.sublist), first+rows); i++ {
+		kid := n.sublist[i]
 		pfx := pfxItem
 		if kid == ds.currentItem {
 			if vd.editorLol.modeMove {
@@ -239,22 +323,85 @@ func updateMainPane() {
 				pfx = pfxFocusedItem
 			}
 		}
+		// Links show the item they link to.
+		item := kid.resolve()
 		sfx := ""
-		if len(kid.sublist) > 0 {
-			sfx = sfxMore
+		if ds.linkCount(item) > 0 {
+			sfx += sfxShared
+		}
+		if item.note != "" {
+			sfx += sfxNote
 		}
-		line := pfx + kid.label + sfx
+		if item.query != "" {
+			sfx += sfxQuery
+		}
+		if item.mount != nil {
+			sfx += sfxMount
+		}
+		if len(item.sublist) > 0 {
+			sfx += sfxMore
+		}
+		label := priorityPrefix(item) + ds.expandRefs(item) + dateSuffix(item, now)
+		if n.view != nil && n.view.describe != nil {
+			label = n.view.describe(kid)
+		}
+		line := pfx + label + sfx
 		if kid.tagged {
 			line = colorString(line, BG_BLACK, FG_CYAN, "")
 		}
+		line = vd.editorLol.gutterLabel(i, len(n.sublist)) + line
 		fmt.Fprintln(vd.paneMain, line)
 	}
+	if cur >= 0 {
+		vd.paneMain.SetCursor(0, cur-first+2)
+	}
 	// For now, if you need to update main view, you likely need to update
 	// status as well.
 	// TODO: find better location, system.
 	updateStatusPane()
 }
 
+// Builds the title line for list 'n': the path of lists leading from root
+// down to it. Each crumb is numbered by its depth, which is what the jump to
+// ancestor command expects. If the path does not fit in 'width', the crumbs
+// just below root are elided first, and only then is the result truncated.
+func breadcrumb(n *node, width int) string {
+	path := n.ancestry()
+	crumbs := make([]string, len(path))
+	for i, p := range path {
+		label := p.label
+		if p == ds.root {
+			label = filepath.Base(ds.filename)
+		}
+		crumbs[i] = fmt.Sprintf("%d:%s", i, label)
+	}
+
+	join := func(cs []string) string {
+		return "▶ " + strings.Join(cs, sepCrumb)
+	}
+	s := join(crumbs)
+	if width <= 0 {
+		// Pane not laid out yet; nothing to fit to.
+		return s
+	}
+	// Always keep root and the current list itself.
+	for drop := 1; runeLen(s) > width && drop < len(crumbs)-1; drop++ {
+		cs := append([]string{crumbs[0], "…"}, crumbs[drop+1:]...)
+		s = join(cs)
+	}
+	return truncateString(s, width)
+}
+
+// Describes item along with where it is; for views gathering items from all
+// over the tree.
+func describeWithPath(n *node) string {
+	text := priorityPrefix(n.resolve()) + n.resolve().label
+	if path := n.parent.pathString(); path != "" {
+		text += "  (" + path + ")"
+	}
+	return text
+}
+
 func updateStatusPane() {
 	if vd.paneInfo == nil {
 		return
@@ -269,11 +416,45 @@ func updateStatusPane() {
 		s = "NOT dirty"
 	}
 	fmt.Fprintln(vd.paneInfo, s)
+	if ds.sealed != nil {
+		fmt.Fprintln(vd.paneInfo, "ENCRYPTED; L to unlock")
+	} else if ds.crypt != nil {
+		fmt.Fprintln(vd.paneInfo, "encrypted")
+	}
+
+	if le := vd.editorLol; le != nil && le.count > 0 {
+		fmt.Fprintf(vd.paneInfo, "count prefix = %d\n", le.count)
+	}
 
 	if ds.currentItem != nil {
-		count, depth := ds.currentItem.Analyze()
+		item := ds.currentItem.resolve()
+		count, depth := ds.analyze(item)
 		fmt.Fprintf(vd.paneInfo, "depth = %d\n", depth)
 		fmt.Fprintf(vd.paneInfo, "count = %d\n", count)
+		if item != ds.currentItem {
+			fmt.Fprintf(vd.paneInfo, "link to: %s\n", item.pathString())
+		} else if k := ds.linkCount(item); k > 0 {
+			fmt.Fprintf(vd.paneInfo, "links = %d\n", k)
+		}
+		if k := ds.backlinkCount(item); k > 0 {
+			fmt.Fprintf(vd.paneInfo, "backlinks = %d\n", k)
+		}
+		if p := item.priority; p != 0 {
+			fmt.Fprintf(vd.paneInfo, "priority = %s\n", priorityLetter(p))
+		}
+		if dates := formatDateTokens(item); dates != "" {
+			fmt.Fprintln(vd.paneInfo, dates)
+		}
+		if note := item.note; note != "" {
+			fmt.Fprintf(vd.paneInfo, "note: %s\n", note)
+		}
+		if item.mount != nil {
+			s := "mounts: " + item.mount.path
+			if item.mount.dirty {
+				s += " (modified)"
+			}
+			fmt.Fprintln(vd.paneInfo, s)
+		}
 	}
 }
 
@@ -303,35 +484,20 @@ func keybindings(g *gocui.Gui, ds *dataStore) error {
 	return nil
 }
 
-func quit(g *gocui.Gui, v *gocui.View) error {
-	return gocui.ErrQuit
-}
-
-func setmain(g *gocui.Gui, v *gocui.View) error {
-	g.SetCurrentView("main")
-	return nil
+// Runs 'f' with the terminal released from the GUI (e.g., so that an external
+// program can use it), then brings the GUI back up.
+func suspendGui(f func()) {
+	vd.onSuspend = f
+	vd.gui.Update(func(g *gocui.Gui) error {
+		return errSuspend
+	})
 }
 
-func main() {
-	flag.Parse()
-
-	// Set up data.
-	if _, err := os.Stat(*filename); err == nil {
-		ds.load()
-		ds.init()
-	} else {
-		fmt.Printf("Unable to stat %q; creating empty dataStore instead.\n", *filename)
-		ds.init()
-	}
-
-	setTitle(filepath.Base(*filename))
-
-	// Set up GUI.
+func startGui() *gocui.Gui {
 	g, err := gocui.NewGui(gocui.Output256)
 	if err != nil {
 		Log(err.Error())
 	}
-	defer g.Close()
 	vd.gui = g
 
 	// Does this do anything?
@@ -340,24 +506,100 @@ func main() {
 
 	g.SetManagerFunc(layout)
 
-	if err := keybindings(g, &ds); err != nil {
+	if err := keybindings(g, ds); err != nil {
 		Log(err.Error())
 	}
+	return g
+}
 
-	// Main interaction loop.
-	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
-		Log(err.Error())
+func quit(g *gocui.Gui, v *gocui.View) error {
+	return gocui.ErrQuit
+}
+
+func setmain(g *gocui.Gui, v *gocui.View) error {
+	g.SetCurrentView("main")
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	// Subcommands, which work on files without bringing up the editor.
+	switch flag.Arg(0) {
+	case "merge":
+		os.Exit(mergeMain(flag.Args()[1:]))
+	case "diff":
+		os.Exit(diffMain(flag.Args()[1:]))
 	}
 
+	// Set up data: a buffer for each file given, else for -f.
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{*filename}
+	}
+	for _, path := range paths {
+		if openBuffer(path, *readOnly, true) == nil {
+			for _, b := range buffers {
+				b.releaseLock()
+			}
+			os.Exit(1)
+		}
+	}
+	defer func() {
+		for _, b := range buffers {
+			b.releaseLock()
+		}
+	}()
+	ds = buffers[0]
+
+	setTitle(filepath.Base(ds.filename))
+
+	// Main interaction loop. The GUI is set up anew after each time it
+	// gets suspended.
+	g := startGui()
+	cmdUnlock()
+	cmdOfferRecovery()
+	stopWatching := make(chan struct{})
+	go watchFiles(g, stopWatching)
+	for {
+		err := g.MainLoop()
+		close(stopWatching)
+		if err != errSuspend {
+			if err != nil && err != gocui.ErrQuit {
+				Log(err.Error())
+			}
+			break
+		}
+		g.Close()
+		f := vd.onSuspend
+		vd.onSuspend = nil
+		f()
+		g = startGui()
+		stopWatching = make(chan struct{})
+		go watchFiles(g, stopWatching)
+	}
+	defer g.Close()
+
 	fmt.Printf("Quitting... ")
-	if ds.dirty {
+	for _, b := range buffers {
+		if !b.dirty || b.readOnly {
+			continue
+		}
 		// TODO: better dialog, using gocui
 		// FWIW, a yes/no dialog attempt by someone else:
 		//   https://aqatl.github.io/trego/2017/03/13/simple-prompt-dialog-in-gocui.html
-		fmt.Printf("save first? [y/n] ")
+		fmt.Printf("save %q first? [y/n] ", b.filename)
 		x := readString()
-		if strings.HasPrefix(x, "y") {
-			ds.save()
+		if strings.HasPrefix(x, "y") && (!b.changedOnDisk() || b.confirmOverwrite()) {
+			b.save()
+		} else {
+			// Dropped on purpose; nothing to recover.
+			b.dirty = false
+		}
+	}
+	for _, b := range buffers {
+		if !b.dirty {
+			b.removeJournal()
 		}
 	}
 }
@@ -2,18 +2,56 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/jroimartin/gocui"
 )
 
+// What to show in the gutter left of each item in the current list.
+const (
+	GUTTER_NONE       = iota
+	GUTTER_NUMBERS    // item numbers, starting from 1
+	GUTTER_DIGIT_JUMP // as above, and single digit jumps straight to item
+)
+
+// Digit-jump only makes sense if every item is reachable by one digit.
+const DIGIT_JUMP_MAX_ITEMS = 10
+
+// Keys of commands changing items (or the tree), not available on read-only
+// lists, nor in read-only mode. Except M, which on read-only lists restores
+// rather than moves.
+const KEYS_CHANGING = "aoreEN@+!Qs=~pPUdDXcI"
+
+// Keys of further commands changing the tree, which on read-only lists are
+// refused anyway, or mean something else.
+const KEYS_CHANGING_TOO = "mfFMC"
+
+// Keys of those changing commands which add items next to the current one,
+// rather than change it.
+const KEYS_ADDING = "aopPUI"
+
+// Upper bound on count prefixes, so that a stuck key cannot overflow it.
+const COUNT_MAX = 99999
+
 type LolEditor struct {
 	modeMove bool
+	// Set to the first key of a multi-key command, until the command is
+	// completed by the next key (e.g., '^' awaits the ancestor depth, '!'
+	// the priority).
+	pending rune
+	// Vim-like count prefix typed so far (e.g., 5 in "5j"); 0 if none.
+	count int
+	// One of GUTTER_*.
+	gutter int
 	// TODO: probably all of viewData should be moved here
 	// TODO: also, probably current list + current item + tagged should
 	// move here too.
 }
 
 func (le *LolEditor) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	if le.pending == 0 && le.DigitMode(ch) {
+		return
+	}
 	if le.modeMove {
 		le.MoveMode(v, key, ch, mod)
 	} else {
@@ -21,10 +59,65 @@ func (le *LolEditor) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modif
 	}
 }
 
+// Handles digit keys, which either jump straight to an item (in digit-jump
+// mode, on short enough lists) or accumulate a count prefix for the next
+// command. Returns false if the key was not consumed.
+func (le *LolEditor) DigitMode(ch rune) bool {
+	if ch < '0' || ch > '9' {
+		return false
+	}
+	if le.digitJumpActive() && le.count == 0 {
+		// Keys 1 through 9, then 0 for the 10th item.
+		idx := int(ch-'0') - 1
+		if idx < 0 {
+			idx = 9
+		}
+		cmdJumpToItem(idx)
+		return true
+	}
+	if ch == '0' && le.count == 0 {
+		// A leading '0' is a command in its own right.
+		return false
+	}
+	le.count = min(le.count*10+int(ch-'0'), COUNT_MAX)
+	updateStatusPane()
+	return true
+}
+
+// Returns the count prefix typed so far (1 if none was), and whether there
+// was one. Resets the count, as it only ever applies to the next command.
+func (le *LolEditor) takeCount() (int, bool) {
+	count := le.count
+	le.count = 0
+	if count == 0 {
+		return 1, false
+	}
+	return count, true
+}
+
+func (le *LolEditor) digitJumpActive() bool {
+	return !le.modeMove && le.gutter == GUTTER_DIGIT_JUMP &&
+		len(ds.currentList.sublist) <= DIGIT_JUMP_MAX_ITEMS
+}
+
+// Returns what to show in the gutter for item at 'idx', if anything.
+func (le *LolEditor) gutterLabel(idx, nItems int) string {
+	switch {
+	case le.gutter == GUTTER_NONE:
+		return ""
+	case le.digitJumpActive():
+		return fmt.Sprintf("%d ", (idx+1)%10)
+	default:
+		width := len(fmt.Sprint(nItems))
+		return fmt.Sprintf("%*d ", width, idx+1)
+	}
+}
+
 func (le *LolEditor) MoveMode(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 	idx := ds.currentItemIndex()
 	max_idx := len(ds.currentList.sublist) - 1
 	new_idx := -1
+	count, _ := le.takeCount()
 
 	switch {
 	case ch == 'q' || key == gocui.KeyEnter:
@@ -33,7 +126,7 @@ func (le *LolEditor) MoveMode(v *gocui.View, key gocui.Key, ch rune, mod gocui.M
 		updateMainPane()
 	case ch == 'k':
 		if idx > 0 {
-			new_idx = idx - 1
+			new_idx = max(idx-count, 0)
 		}
 	case ch == 'K' || ch == '0':
 		if idx > 0 {
@@ -41,14 +134,14 @@ func (le *LolEditor) MoveMode(v *gocui.View, key gocui.Key, ch rune, mod gocui.M
 		}
 	case ch == 'j':
 		if idx < max_idx {
-			new_idx = idx + 1
+			new_idx = min(idx+count, max_idx)
 		}
 	case ch == 'J' || ch == 'e' || ch == '-':
 		if idx < max_idx {
 			new_idx = max_idx
 		}
 	}
-	if new_idx >= 0 {
+	if new_idx >= 0 && requireWritable() {
 		ds.moveItemToIndex(new_idx)
 		updateMainPane()
 		// Update the cursor as well.
@@ -57,33 +150,80 @@ func (le *LolEditor) MoveMode(v *gocui.View, key gocui.Key, ch rune, mod gocui.M
 }
 
 func (le *LolEditor) NormalMode(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	if le.pending != 0 {
+		le.PendingMode(v, key, ch, mod)
+		return
+	}
+
+	count, counted := le.takeCount()
+
+	changing := strings.ContainsRune(KEYS_CHANGING, ch) || key == gocui.KeyCtrlZ
+	if (changing || strings.ContainsRune(KEYS_CHANGING_TOO, ch)) && !requireWritable() {
+		return
+	}
+	if v := ds.currentList.view; v != nil && v.readOnly && changing {
+		Log("Read-only; use M to restore item to Target.")
+		return
+	}
+	if it := ds.currentItem; it != nil && it.enter != nil &&
+		strings.ContainsRune(KEYS_CHANGING, ch) && !strings.ContainsRune(KEYS_ADDING, ch) {
+		Log("Not possible on %s.", it.label)
+		return
+	}
+
 	switch {
 	case ch == 'm':
+		if !requireTreeList() {
+			break
+		}
 		Log("Switched to MOVE mode.")
 		le.modeMove = true
 		updateMainPane()
 	case ch == 'j' || key == gocui.KeyArrowDown:
-		cmdNextItem()
+		cmdNextItem(count)
 	case ch == 'k' || key == gocui.KeyArrowUp:
-		cmdPrevItem()
+		cmdPrevItem(count)
+	case (ch == 'G' || ch == 'g') && counted:
+		// Items are numbered from 1, as in the gutter.
+		cmdJumpToItem(count - 1)
 	case ch == 'J' || ch == '$' || ch == '-' || ch == 'G':
 		cmdLastItem()
 	case ch == 'K' || ch == '0' || ch == 'g':
 		cmdFirstItem()
+	case ch == '#':
+		cmdCycleGutter()
 	case ch == 'a' || ch == 'o':
 		cmdAddItems()
 	case ch == 'r':
 		cmdReplaceItem()
 	case ch == '<' || ch == 'u':
 		cmdAscend()
+	case ch == '^' && counted:
+		cmdJumpToAncestor(count)
+	case ch == '^':
+		le.pending = ch
 	case ch == '>' || key == gocui.KeyEnter:
 		cmdDescend()
 	case ch == 'S':
 		cmdSaveData()
 	case ch == 'L':
 		cmdLoadData()
+	case ch == 'R':
+		cmdToggleReadOnly()
+	case ch == 'b' && counted:
+		cmdSwitchBuffer(count)
+	case ch == 'b':
+		cmdSwitchBuffer(0)
+	case ch == 'O':
+		cmdOpenFile()
+	case ch == 'W':
+		cmdCloseBuffer()
+	case ch == 'I':
+		cmdMountFile()
+	case ch == 'C':
+		cmdSetPassphrase()
 	case key == gocui.KeySpace:
-		cmdToggleItem()
+		cmdToggleItem(count)
 	case key == gocui.KeyCtrlT:
 		// Can't use gocuy.KeyCtrlSpace as it == 0 / matches most
 		// regular keypresses (because key == 0 then)
@@ -92,16 +232,76 @@ func (le *LolEditor) NormalMode(v *gocui.View, key gocui.Key, ch rune, mod gocui
 		cmdFoldItems()
 	case ch == 'F':
 		cmdUnfoldItems()
+	case ch == 'e':
+		cmdEditInEditor(false)
+	case ch == 'E':
+		cmdEditInEditor(true)
+	case ch == 'N':
+		cmdEditNote()
+	case ch == '@':
+		cmdEditDates()
+	case ch == 'A':
+		cmdShowAgenda()
+	case ch == '+':
+		cmdEditTags()
+	case ch == '*':
+		cmdShowTags()
+	case ch == 'Q':
+		cmdEditQuery()
+	case ch == 'y':
+		cmdCopyRef()
+	case ch == ']':
+		// Count picks which reference, if there are several.
+		cmdFollowRef(count - 1)
+	case ch == '[':
+		cmdShowBacklinks()
+	case ch == 'H':
+		cmdShowHistory()
+	case ch == '!' && counted:
+		cmdSetPriority(min(count, PRIORITY_LOWEST))
+	case ch == '!':
+		le.pending = ch
+	case ch == 'v' || ch == 'V':
+		// Count, if any, is the lowest priority included.
+		p := 0
+		if counted {
+			p = min(count, PRIORITY_LOWEST)
+		}
+		if ch == 'v' {
+			cmdFilterByPriority(p)
+		} else {
+			cmdShowTopPriorities(p)
+		}
+	case ch == '/':
+		cmdSearch()
+	case ch == 'n':
+		cmdSearchNext()
+	case ch == 's':
+		cmdSortItems()
+	case ch == '=':
+		cmdDedupeItems()
+	case ch == '~':
+		cmdShuffleItems()
+	case key == gocui.KeyCtrlZ:
+		cmdUndo()
 	case ch == 't':
 		cmdSetUserTarget()
 	case ch == 'T':
 		cmdGoToUserTarget()
 	case ch == 'M':
-		cmdMoveCurrentItemToTarget(&ds.Mark)
+		cmdMoveCurrentItemToTarget(ds.Mark, count)
+	case ch == 'c':
+		cmdLinkCurrentItemAtTarget(ds.Mark)
+	case ch == 'p':
+		cmdPullFromTarget(ds.Mark, count)
+	case ch == 'P':
+		cmdReopenFromDone(count)
+	case ch == 'U':
+		cmdRestoreFromTrash(count)
 	case ch == 'd':
-		cmdMoveToDone()
+		cmdMoveToDone(count)
 	case ch == 'D':
-		cmdMoveToTrash()
+		cmdMoveToTrash(count)
 	case ch == 'X':
 		cmdExpungeTrash()
 		/*
@@ -113,4 +313,23 @@ func (le *LolEditor) NormalMode(v *gocui.View, key gocui.Key, ch rune, mod gocui
 	}
 }
 
+// Completes a multi-key command started in NORMAL mode.
+func (le *LolEditor) PendingMode(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	first := le.pending
+	le.pending = 0
+
+	switch {
+	case first == '^' && ch >= '0' && ch <= '9':
+		cmdJumpToAncestor(int(ch - '0'))
+	case first == '!':
+		if p, ok := parsePriority(ch); ok {
+			cmdSetPriority(p)
+		} else {
+			fmt.Printf("\007") // BELL
+		}
+	default:
+		fmt.Printf("\007") // BELL
+	}
+}
+
 // vim: fdm=syntax
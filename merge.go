@@ -0,0 +1,536 @@
+package main
+
+// Three-way merge of list files, e.g. of copies edited on different machines
+// since they were last the same:
+//
+//	loled merge [-o OUT] BASE OURS THEIRS
+//
+// The result replaces OURS, unless written to OUT instead, and exit status is
+// 1 if there were conflicts. That is what git expects of a merge driver, so
+// with
+//
+//	.gitattributes:  *.lol merge=loled
+//	.git/config:     [merge "loled"]
+//	                         name = loled list merge
+//	                         driver = loled merge %O %A %B
+//
+// git merges list files this way.
+//
+// Items are matched by id, which stays with an item for good; items added by
+// both sides are also matched by label, among kids of the same item. Edits of
+// label, note, dates etc., moves, reorders, additions and removals made by
+// either side are all combined. Where the sides disagree ours wins, and an
+// item tagged #conflict, placed first below the affected item, tells what
+// theirs had.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const CONFLICT_TAG = "#conflict"
+
+// Parts of an item merged independently of each other.
+var mergeFields = []struct {
+	name string
+	get  func(n *node) string
+	set  func(dst, src *node)
+}{
+	{"label",
+		func(n *node) string { return n.label },
+		func(dst, src *node) { dst.label = src.label }},
+	{"note",
+		func(n *node) string { return n.note },
+		func(dst, src *node) { dst.note = src.note }},
+	{"due",
+		func(n *node) string { return n.due.Format(DATE_FORMAT) },
+		func(dst, src *node) { dst.due = src.due }},
+	{"scheduled",
+		func(n *node) string { return n.scheduled.Format(DATE_FORMAT) },
+		func(dst, src *node) { dst.scheduled = src.scheduled }},
+	{"repeat",
+		func(n *node) string { return n.repeat },
+		func(dst, src *node) { dst.repeat = src.repeat }},
+	{"priority",
+		func(n *node) string { return strconv.Itoa(n.priority) },
+		func(dst, src *node) { dst.priority = src.priority }},
+	{"query",
+		func(n *node) string { return n.query },
+		func(dst, src *node) { dst.query = src.query }},
+	{"link",
+		func(n *node) string {
+			if n.link == nil {
+				return ""
+			}
+			return strconv.Itoa(n.link.id)
+		},
+		// Points into the side for now; see mergeTrees().
+		func(dst, src *node) { dst.link = src.link }},
+	{"mount",
+		func(n *node) string {
+			if n.mount == nil {
+				return ""
+			}
+			return n.mount.path
+		},
+		func(dst, src *node) {
+			switch {
+			case src.mount == nil:
+				dst.mount = nil
+			case dst.mount == nil || dst.mount.path != src.mount.path:
+				dst.mount = newMount(src.mount.path)
+			}
+		}},
+}
+
+// One version taking part in a merge, with its nodes by id.
+type mergeSide struct {
+	tree  fileTree
+	nodes map[int]*node
+}
+
+func newMergeSide(t fileTree) *mergeSide {
+	s := &mergeSide{t, make(map[int]*node)}
+	for _, n := range t.root.preorder() {
+		s.nodes[n.id] = n
+	}
+	return s
+}
+
+// Returns id of parent of node 'id', or -1 if there is no such node (or it
+// has no parent).
+func (s *mergeSide) parent(id int) int {
+	n := s.nodes[id]
+	if n == nil || n.parent == nil {
+		return -1
+	}
+	return n.parent.id
+}
+
+// Returns ids of kids of node 'id' that are in 'keep', in order.
+func (s *mergeSide) kids(id int, keep map[int]bool) []int {
+	ids := []int{}
+	if n := s.nodes[id]; n != nil {
+		for _, kid := range n.sublist {
+			if keep[kid.id] {
+				ids = append(ids, kid.id)
+			}
+		}
+	}
+	return ids
+}
+
+type merger struct {
+	base, ours, theirs *mergeSide
+	// What the merged tree is to have.
+	present map[int]bool
+	parent  map[int]int
+	// Conflicts, by id of the item they concern.
+	conflicts map[int][]string
+	// Highest id used anywhere, for giving out fresh ones.
+	lastId int
+}
+
+func (m *merger) conflict(id int, format string, a ...interface{}) {
+	m.conflicts[id] = append(m.conflicts[id], fmt.Sprintf(format, a...))
+}
+
+func (m *merger) freshId() int {
+	m.lastId++
+	return m.lastId
+}
+
+// Returns whether side node 'n' differs from base node 'b' in content or
+// place.
+func changedFromBase(b, n *node) bool {
+	for _, f := range mergeFields {
+		if f.get(b) != f.get(n) {
+			return true
+		}
+	}
+	return parentIdOf(b) != parentIdOf(n)
+}
+
+func parentIdOf(n *node) int {
+	if n.parent == nil {
+		return -1
+	}
+	return n.parent.id
+}
+
+// Sorted ids of nodes the merged tree is to have.
+func (m *merger) presentIds() []int {
+	ids := []int{}
+	for id := range m.present {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Items added by both sides, below the same item and with the same label, are
+// taken to be the same. Other items added by theirs may have ids clashing with
+// ours; those get fresh ids.
+func (m *merger) matchAdded() {
+	taken := make(map[*node]bool)
+	for _, tn := range m.theirs.tree.root.preorder() {
+		if tn.parent == nil || m.base.nodes[tn.id] != nil {
+			continue
+		}
+		var match *node
+		if on := m.ours.nodes[tn.parent.id]; on != nil {
+			for _, kid := range on.sublist {
+				if m.base.nodes[kid.id] == nil && !taken[kid] && kid.label == tn.label {
+					match = kid
+					break
+				}
+			}
+		}
+		if match != nil {
+			taken[match] = true
+			tn.id = match.id
+		} else if m.ours.nodes[tn.id] != nil {
+			tn.id = m.freshId()
+		}
+	}
+	m.theirs = newMergeSide(m.theirs.tree)
+}
+
+// Decides which items the merged tree keeps.
+func (m *merger) mergePresence() {
+	ids := make(map[int]bool)
+	for _, s := range []*mergeSide{m.base, m.ours, m.theirs} {
+		for id := range s.nodes {
+			ids[id] = true
+		}
+	}
+	for id := range ids {
+		b, o, t := m.base.nodes[id], m.ours.nodes[id], m.theirs.nodes[id]
+		switch {
+		case o != nil && t != nil, b == nil:
+			m.present[id] = true
+		case o != nil:
+			if changedFromBase(b, o) {
+				m.present[id] = true
+				m.conflict(id, "removed by theirs, but changed by ours")
+			}
+		case t != nil:
+			if changedFromBase(b, t) {
+				m.present[id] = true
+				m.conflict(id, "removed by ours, but changed by theirs")
+			}
+		}
+		// Else removed by both.
+	}
+}
+
+// Returns where item 'id' is to go: under the parent given by whichever side
+// moved it.
+func (m *merger) mergeParent(id int) int {
+	b, o, t := m.base.parent(id), m.ours.parent(id), m.theirs.parent(id)
+	switch {
+	case m.ours.nodes[id] == nil && m.theirs.nodes[id] == nil:
+		return b
+	case m.ours.nodes[id] == nil:
+		return t
+	case m.theirs.nodes[id] == nil, o == t, t == b:
+		return o
+	case o == b:
+		return t
+	}
+	if p := m.theirs.nodes[t]; p != nil {
+		m.conflict(id, "moved by theirs, below %q", p.label)
+	}
+	return o
+}
+
+// Keeps tree whole: items are brought back if something kept is below them or
+// links to them, and cycles made by moves of both sides are broken.
+func (m *merger) repairTree(rootId int) {
+	for changed := true; changed; {
+		changed = false
+		for _, id := range m.presentIds() {
+			needed := []int{}
+			if id != rootId {
+				needed = append(needed, m.parent[id])
+			}
+			for _, s := range []*mergeSide{m.ours, m.theirs} {
+				if n := s.nodes[id]; n != nil && n.link != nil {
+					needed = append(needed, n.link.id)
+				}
+			}
+			for _, p := range needed {
+				if p < 0 || m.present[p] {
+					continue
+				}
+				m.present[p] = true
+				m.parent[p] = m.mergeParent(p)
+				m.conflict(p, "removed, but still in use by the other side")
+				changed = true
+			}
+		}
+
+		// Follow each item up toward root, to find cycles. Any cycle
+		// has at least one move made by theirs (ours alone being a
+		// proper tree); undo that.
+		for _, id := range m.presentIds() {
+			path := []int{}
+			onPath := make(map[int]int)
+			p := id
+			for ; p != rootId && p >= 0; p = m.parent[p] {
+				if _, ok := onPath[p]; ok {
+					break
+				}
+				onPath[p] = len(path)
+				path = append(path, p)
+			}
+			if p == rootId || p < 0 {
+				continue
+			}
+			for _, q := range path[onPath[p]:] {
+				if o := m.ours.parent(q); o != m.parent[q] {
+					if o < 0 {
+						o = rootId
+					}
+					m.parent[q] = o
+					m.conflict(q, "moved by both sides into each other; kept ours")
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// Returns ids of kids of 'id' in merged order: that of the side which
+// reordered them, with items only the other side has placed after the item
+// they follow there.
+func (m *merger) mergeOrder(id int, kids map[int]bool) []int {
+	b, o, t := m.base.kids(id, kids), m.ours.kids(id, kids), m.theirs.kids(id, kids)
+	inAll := make(map[int]int)
+	for _, l := range [][]int{b, o, t} {
+		for _, k := range l {
+			inAll[k]++
+		}
+	}
+	common := func(l []int) string {
+		s := []string{}
+		for _, k := range l {
+			if inAll[k] == 3 {
+				s = append(s, strconv.Itoa(k))
+			}
+		}
+		return strings.Join(s, " ")
+	}
+	primary, secondary := o, t
+	if common(o) == common(b) {
+		primary, secondary = t, o
+	}
+
+	order := append([]int{}, primary...)
+	placed := make(map[int]bool)
+	for _, k := range order {
+		placed[k] = true
+	}
+	for i, k := range secondary {
+		if placed[k] {
+			continue
+		}
+		pos := 0
+		for j := i - 1; j >= 0; j-- {
+			if placed[secondary[j]] {
+				for pos < len(order) && order[pos] != secondary[j] {
+					pos++
+				}
+				pos++
+				break
+			}
+		}
+		order = append(order, 0)
+		copy(order[pos+1:], order[pos:])
+		order[pos] = k
+		placed[k] = true
+	}
+	// Anything else (e.g., brought back) goes last.
+	rest := []int{}
+	for k := range kids {
+		if !placed[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Ints(rest)
+	return append(order, rest...)
+}
+
+// Merges 'ours' and 'theirs', both derived from 'base'. Returns the merged
+// tree, and the number of conflicts in it. Trees passed in get changed.
+func mergeTrees(base, ours, theirs fileTree) (fileTree, int) {
+	if base.root == nil {
+		// No common version; as if it was empty.
+		base.root = newNode("root")
+		base.root.id = ours.root.id
+	}
+	m := &merger{
+		base:      newMergeSide(base),
+		ours:      newMergeSide(ours),
+		theirs:    newMergeSide(theirs),
+		present:   make(map[int]bool),
+		parent:    make(map[int]int),
+		conflicts: make(map[int][]string),
+	}
+	for _, s := range []*mergeSide{m.base, m.ours, m.theirs} {
+		m.lastId = max(m.lastId, s.tree.lastId)
+		for id := range s.nodes {
+			m.lastId = max(m.lastId, id)
+		}
+	}
+	rootId := ours.root.id
+
+	m.matchAdded()
+	m.mergePresence()
+	m.present[rootId] = true
+	for id := range m.present {
+		if id != rootId {
+			m.parent[id] = m.mergeParent(id)
+		}
+	}
+	m.repairTree(rootId)
+
+	// Build merged nodes, taking each part of an item from whichever side
+	// changed it.
+	nodes := make(map[int]*node)
+	for _, id := range m.presentIds() {
+		b, o, t := m.base.nodes[id], m.ours.nodes[id], m.theirs.nodes[id]
+		if o == nil {
+			o = b
+		}
+		if t == nil {
+			t = b
+		}
+		if o == nil {
+			o = t
+		}
+		if t == nil {
+			t = o
+		}
+		n := newNode("")
+		n.id = id
+		for _, f := range mergeFields {
+			bv := ""
+			if b != nil {
+				bv = f.get(b)
+			}
+			ov, tv := f.get(o), f.get(t)
+			src := o
+			if ov != tv && ov == bv {
+				src = t
+			} else if ov != tv && tv != bv {
+				m.conflict(id, "%s changed by theirs to %q", f.name, tv)
+			}
+			f.set(n, src)
+		}
+		nodes[id] = n
+	}
+	for _, n := range nodes {
+		if n.link != nil {
+			n.link = nodes[n.link.id]
+		}
+	}
+
+	// Put together the tree; conflicts go first on the list of the item
+	// they concern.
+	kids := make(map[int]map[int]bool)
+	for _, id := range m.presentIds() {
+		if id == rootId {
+			continue
+		}
+		if kids[m.parent[id]] == nil {
+			kids[m.parent[id]] = make(map[int]bool)
+		}
+		kids[m.parent[id]][id] = true
+	}
+	count := 0
+	for _, id := range m.presentIds() {
+		n := nodes[id]
+		for _, msg := range m.conflicts[id] {
+			c := newNode(CONFLICT_TAG + " " + msg)
+			c.id = m.freshId()
+			n.insertKid(len(n.sublist), c)
+			count++
+		}
+		for _, k := range m.mergeOrder(id, kids[id]) {
+			n.insertKid(len(n.sublist), nodes[k])
+		}
+	}
+
+	result := fileTree{root: nodes[rootId], lastId: m.lastId}
+	if ours.done != nil {
+		result.done = nodes[ours.done.id]
+	}
+	if ours.trash != nil {
+		result.trash = nodes[ours.trash.id]
+	}
+	return result, count
+}
+
+// Runs "loled merge" with (the rest of) command line 'args'. Returns exit
+// status.
+func mergeMain(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	out := fs.String("o", "", "File to write result to, instead of OURS.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge [-o OUT] BASE OURS THEIRS\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 3 {
+		fs.Usage()
+		return 2
+	}
+
+	trees := make([]fileTree, 3)
+	for i, path := range fs.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if i == 0 && strings.Trim(string(data), whitespace) == "" {
+			// No common version.
+			continue
+		}
+		if trees[i], err = parseTree(data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+	}
+
+	result, conflicts := mergeTrees(trees[0], trees[1], trees[2])
+
+	if *out == "" {
+		*out = fs.Arg(1)
+	}
+	var buf bytes.Buffer
+	if err := result.write(&buf); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *out, err)
+		return 2
+	}
+	if err := ioutil.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if conflicts > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d conflict(s), see items tagged %s.\n",
+			*out, conflicts, CONFLICT_TAG)
+		return 1
+	}
+	return 0
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns a tree made from 'spec': an item a line, as "ID LABEL", indented
+// with tabs one deeper than the item it is below.
+func specTree(t *testing.T, spec string) fileTree {
+	t.Helper()
+	root := newNode("root")
+	root.id = ROOT_ID
+	tree := fileTree{root: root, lastId: ROOT_ID}
+	stack := []*node{root}
+	for _, l := range strings.Split(spec, "\n") {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		item := strings.TrimLeft(l, "\t")
+		depth := len(l) - len(item)
+		if depth >= len(stack) {
+			t.Fatalf("bad spec line %q", l)
+		}
+		f := strings.SplitN(item, " ", 2)
+		id, err := strconv.Atoi(f[0])
+		if err != nil || len(f) != 2 {
+			t.Fatalf("bad spec line %q", l)
+		}
+		n := newNode(f[1])
+		n.id = id
+		p := stack[depth]
+		p.insertKid(len(p.sublist), n)
+		stack = append(stack[:depth+1], n)
+		tree.lastId = max(tree.lastId, id)
+	}
+	return tree
+}
+
+// Returns items of 'tree' as an outline.
+func outlineOf(tree fileTree) string {
+	var buf bytes.Buffer
+	writeOutline(&buf, tree.root.sublist, 0)
+	return buf.String()
+}
+
+func TestMergeTrees(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		conflicts          int
+	}{
+		{"unchanged",
+			"2 a\n3 b", "2 a\n3 b", "2 a\n3 b",
+			"a\nb\n", 0},
+		{"different items renamed",
+			"2 a\n3 b", "2 A\n3 b", "2 a\n3 B",
+			"A\nB\n", 0},
+		{"renamed alike",
+			"2 a", "2 x", "2 x",
+			"x\n", 0},
+		{"renamed differently",
+			"2 a", "2 x", "2 y",
+			"x\n\t#conflict label changed by theirs to \"y\"\n", 1},
+		{"removed by theirs",
+			"2 a\n3 b", "2 a\n3 b", "3 b",
+			"b\n", 0},
+		{"removed by ours, changed by theirs",
+			"2 a\n3 b", "3 b", "2 A\n3 b",
+			"A\n\t#conflict removed by ours, but changed by theirs\nb\n", 1},
+		{"added by both alike",
+			"2 a", "2 a\n3 new", "2 a\n3 new",
+			"a\nnew\n", 0},
+		{"added by both with the same id",
+			"2 a", "2 a\n3 x", "2 a\n3 y",
+			"a\nx\ny\n", 0},
+		{"moved by theirs",
+			"2 a\n3 b", "2 a\n3 b", "2 a\n\t3 b",
+			"a\n\tb\n", 0},
+		{"moved by both",
+			"2 a\n3 b\n4 c", "2 a\n\t4 c\n3 b", "2 a\n3 b\n\t4 c",
+			"a\n\tc\n\t\t#conflict moved by theirs, below \"b\"\nb\n", 1},
+		{"reordered by ours, added to by theirs",
+			"2 a\n3 b\n4 c", "3 b\n2 a\n4 c", "2 a\n3 b\n4 c\n5 d",
+			"b\na\nc\nd\n", 0},
+		{"added below item removed",
+			"2 a", "", "2 a\n\t3 k",
+			"a\n\t#conflict removed, but still in use by the other side\n\tk\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := mergeTrees(specTree(t, tt.base),
+				specTree(t, tt.ours), specTree(t, tt.theirs))
+			if got := outlineOf(merged); got != tt.want {
+				t.Errorf("merged:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if conflicts != tt.conflicts {
+				t.Errorf("%d conflicts, want %d", conflicts, tt.conflicts)
+			}
+			seen := make(map[int]bool)
+			for _, n := range merged.root.preorder() {
+				if seen[n.id] {
+					t.Errorf("id %d used twice", n.id)
+				}
+				seen[n.id] = true
+				if n.id > merged.lastId {
+					t.Errorf("id %d above LASTID %d", n.id, merged.lastId)
+				}
+			}
+		})
+	}
+}
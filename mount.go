@@ -0,0 +1,221 @@
+package main
+
+// Mounts: items whose sublist is another file, e.g. a list shared by a team,
+// mounted in the lists of each of its members. A mounted file is loaded when
+// first entered, and saved back (if changed) whenever the file it is mounted
+// in is saved. Its items are kept apart from those of the file it is mounted
+// in, as those of another buffer would be: references by id, searches etc.
+// do not reach into it, and moving items in or out of it copies them.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type mount struct {
+	// File as given, relative to the directory of the file mounted in.
+	path string
+	// Set once loaded.
+	loaded bool
+	// Of the mounted file; see fileTree.
+	rootId      int
+	lastId      int
+	done, trash *Target
+	// The file as last loaded or saved.
+	disk diskState
+	// Set when items in it may have changed since.
+	dirty bool
+}
+
+func newMount(path string) *mount {
+	return &mount{path: path}
+}
+
+// Returns the mount item whose file the items of list 'l' are in: l itself,
+// or the nearest above it. Nil if they are in the buffer's own file.
+func mountOfList(l *node) *node {
+	for p := l; p != nil; p = p.parent {
+		if p.mount != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// Notes that items on list 'l' changed, for the file they are in to be
+// known as modified, if a file mounted.
+func touchMount(l *node) {
+	if m := mountOfList(l); m != nil && m.mount.loaded {
+		m.mount.dirty = true
+		mountChanged(m)
+	}
+}
+
+// Like setting 'dirty', for changes made in place to items on list 'l'
+// (rather than by adding or removing items, which is noted anyway).
+func (ds *dataStore) changedList(l *node) {
+	ds.dirty = true
+	touchMount(l)
+}
+
+// Returns path of the file mounted at 'n'.
+func (ds *dataStore) mountFile(n *node) string {
+	if filepath.IsAbs(n.mount.path) {
+		return n.mount.path
+	}
+	dir := filepath.Dir(ds.filename)
+	if outer := mountOfList(n.parent); outer != nil {
+		dir = filepath.Dir(ds.mountFile(outer))
+	}
+	return filepath.Join(dir, n.mount.path)
+}
+
+// Returns Done and Trash of the file items of list 'l' are in.
+func (ds *dataStore) fileLists(l *node) (*Target, *Target) {
+	if m := mountOfList(l); m != nil && m.mount.loaded {
+		return m.mount.done, m.mount.trash
+	}
+	return ds.markDone, ds.markTrash
+}
+
+// Whether 'n' is Done or Trash of its file.
+func (ds *dataStore) isFileList(n *node) bool {
+	done, trash := ds.fileLists(n.parent)
+	return n == done.list || n == trash.list
+}
+
+// Loads file mounted at 'n' as its sublist. If that fails, the sublist is
+// just a placeholder saying why, which tries again when entered.
+func (ds *dataStore) loadMount(n *node) {
+	m := n.mount
+	path := ds.mountFile(n)
+	n.sublist = []*node{}
+
+	data, err := ioutil.ReadFile(path)
+	var t fileTree
+	if err == nil {
+		t, err = parseTree(data)
+	}
+	if err != nil {
+		p := newNode(fmt.Sprintf("%s%v]]", LABEL_NOT_LOADED, err))
+		p.enter = func() {
+			ds.loadMount(n)
+			ds.setCurrentItemUsingIndex(0)
+		}
+		n.insertKid(0, p)
+		Log("Cannot load %q: %v.", path, err)
+		return
+	}
+
+	for _, kid := range t.root.sublist {
+		n.insertKid(len(n.sublist), kid)
+	}
+	if t.done == nil {
+		t.done = newNode(LABEL_DONE)
+		n.insertKid(len(n.sublist), t.done)
+	}
+	if t.trash == nil {
+		t.trash = newNode(LABEL_TRASH)
+		n.insertKid(len(n.sublist), t.trash)
+	}
+	m.rootId = t.root.id
+	m.lastId = t.lastId
+	m.done = &Target{t.done, 0, true}
+	m.trash = &Target{t.trash, 0, true}
+	m.loaded = true
+	m.dirty = false
+	mountChanged(n)
+	m.disk.saw(path, data)
+}
+
+// Returns file mounted at 'n', as it now is.
+func (ds *dataStore) mountTree(n *node) fileTree {
+	m := n.mount
+	// A stand-in for root of the file; the items stay where they are.
+	root := &node{label: "root", id: m.rootId, sublist: n.sublist}
+	for _, kid := range root.preorder() {
+		m.lastId = max(m.lastId, kid.id)
+	}
+	return fileTree{root: root, done: m.done.list, trash: m.trash.list, lastId: m.lastId}
+}
+
+// Saves files mounted below 'root' (at any depth) which have changed. Any
+// changed on disk meanwhile are left alone.
+func (ds *dataStore) saveMounts(root *node) {
+	for _, n := range root.preorder() {
+		if n.mount == nil || !n.mount.loaded {
+			continue
+		}
+		t := ds.mountTree(n)
+		var buf bytes.Buffer
+		m := n.mount
+		path := ds.mountFile(n)
+		if err := t.write(&buf); err != nil {
+			Log("Error saving to %q: %v; not saved.", path, err)
+		} else if bytes.Equal(buf.Bytes(), m.disk.data) {
+			m.dirty = false
+		} else {
+			if data, err := ioutil.ReadFile(path); err == nil && !bytes.Equal(data, m.disk.data) {
+				Log("%q changed on disk; not saved over (L reloads it).", path)
+			} else {
+				if *backupSuffix != "" {
+					exec.Command("cp", "-a", path, path+*backupSuffix).Run()
+				}
+				if err := writeFileAtomic(path, buf.Bytes(), 0644); err != nil {
+					Log("Error saving to %q: %v.", path, err)
+				} else {
+					m.disk.saw(path, buf.Bytes())
+					m.dirty = false
+					Log("Saved to %q.", path)
+				}
+			}
+		}
+		ds.saveMounts(t.root)
+	}
+}
+
+// Moves files mounted in tree 'old' which are loaded, with their items, over to
+// the same mount items of tree 'root' which is to replace it (those being
+// unloaded, as the tree is new). Returns false, moving none, if any with
+// changes not saved has no such item to go to.
+func carryMounts(old, root *node) bool {
+	loaded := make(map[int]*node)
+	for _, n := range old.preorder() {
+		if n.mount != nil && n.mount.loaded {
+			loaded[n.id] = n
+		}
+	}
+	to := make(map[*node]*node)
+	for _, n := range root.preorder() {
+		if o := loaded[n.id]; o != nil && n.mount != nil && n.mount.path == o.mount.path {
+			to[n] = o
+			delete(loaded, n.id)
+		}
+	}
+	for _, o := range loaded {
+		if o.mount.dirty {
+			return false
+		}
+	}
+	for n, o := range to {
+		n.mount, n.sublist = o.mount, o.sublist
+		for _, kid := range n.sublist {
+			kid.parent = n
+		}
+		o.sublist = []*node{}
+	}
+	return true
+}
+
+// Adds an item mounting file 'path' (relative to the directory of the file it
+// is mounted in, unless absolute) after the current one.
+func (ds *dataStore) appendMount(path string) {
+	n := ds.appendItem(strings.TrimSuffix(filepath.Base(path), ".lol"))
+	n.mount = newMount(path)
+}
+
+// vim: fdm=syntax
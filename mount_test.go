@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testMountFile = "DONE 2\nTRASH 3\n" +
+	"node 1\nroot\n2 3 4\n" +
+	"node 2\n[[DONE]]\n\n" +
+	"node 3\n[[TRASH]]\n\n" +
+	"node 4\nshared item\n\n"
+
+// Returns a saved buffer with a file mounted, loaded and changed.
+func testMountBuffer(t *testing.T) (*dataStore, *node) {
+	*keepHistory = false
+	b := testBuffer(t, "a")
+	path := filepath.Join(filepath.Dir(b.filename), "shared.lol")
+	if err := ioutil.WriteFile(path, []byte(testMountFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.appendMount("shared.lol")
+	m := b.currentItem
+	b.save()
+
+	b.loadMount(m)
+	b.currentList = m
+	b.setCurrentItemUsingIndex(0)
+	b.appendItem("added")
+	if !m.mount.dirty {
+		t.Fatal("file mounted not changed")
+	}
+	return b, m
+}
+
+func TestMergeKeepsMountChanges(t *testing.T) {
+	b, m := testMountBuffer(t)
+	b.mergeFromDisk()
+	if b.root.indexOf(m) >= 0 {
+		t.Fatal("not merged")
+	}
+	var n *node
+	for _, kid := range b.root.sublist {
+		if kid.id == m.id {
+			n = kid
+		}
+	}
+	if n == nil || n.mount == nil || !n.mount.loaded || !n.mount.dirty {
+		t.Fatalf("file mounted not carried over: %+v", n)
+	}
+	if len(itemsLabelled(n, "added")) != 1 {
+		t.Errorf("item added lost: %q", labelsOf(n))
+	}
+}
+
+func TestMergeRefusedLosingMountChanges(t *testing.T) {
+	b, m := testMountBuffer(t)
+	// Mounted elsewhere on disk now.
+	data := []byte("DONE 2\nTRASH 3\nLASTID 9\n" +
+		"node 1\nroot\n2 3\n" +
+		"node 2\n[[DONE]]\n\n" +
+		"node 3\n[[TRASH]]\n\n")
+	if err := ioutil.WriteFile(b.filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.mergeFromDisk()
+	if b.root.indexOf(m) < 0 {
+		t.Error("merged, losing changes in file mounted")
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"strings"
+	"time"
+)
+
 // The underlying model for all data in this program, these list of lists of
 // lists of ..., is essentially a tree. Here, a node is an element in that
 // tree.
@@ -12,6 +17,70 @@ type node struct {
 	sublist []*node
 	// Is it tagged?
 	tagged bool
+	// Optional long-form, possibly multi-line, text attached to the item.
+	note string
+	// Optional dates, by when item is due and on which day it is planned to
+	// be worked on; zero if not set.
+	due       time.Time
+	scheduled time.Time
+	// Optional rule by which the item recurs, once DONE; see
+	// nextOccurrence().
+	repeat string
+	// Optional priority, 1 being highest; 0 if not set.
+	priority int
+	// Set for "smart lists", whose items are found by this query rather
+	// than kept on sublist; see query.go.
+	query string
+	// Set for links, which show this other item in place of themselves; see
+	// links.go.
+	link *node
+	// Identifies item for good: in the save file, in references to it
+	// (see refs.go), etc.
+	id int
+	// Set only for lists which are not part of the tree, but rather put
+	// together on the fly from items found elsewhere in it (e.g., agenda).
+	view *listView
+	// Set only for items which are not part of the tree (nor saved), though
+	// on a list of it, standing in for something else (e.g., recent
+	// files). This is what entering one does.
+	enter func()
+	// Set for items whose sublist is another file; see mount.go.
+	mount *mount
+}
+
+// How to present a list put together from items elsewhere in the tree.
+type listView struct {
+	// Item to return to, on leaving the view.
+	origin *node
+	// Text to show for an item, in place of its bare label.
+	describe func(n *node) string
+	// If set, items are mere stand-ins (e.g., for tags), and this is what
+	// entering one does. Otherwise entering goes to where the item is.
+	open func(n *node)
+	// Set if items are not to be changed (e.g., those of an old version).
+	readOnly bool
+}
+
+// Id of the root node; all other nodes get higher ones.
+const ROOT_ID = 1
+
+// Most recently given out node id. Ids stay with their nodes, saved files
+// included, so are never given out again.
+var lastNodeId = ROOT_ID
+
+// Makes sure ids given out from now on are above 'id' (e.g., one loaded).
+func reserveNodeId(id int) {
+	lastNodeId = max(lastNodeId, id)
+}
+
+// Returns a fresh node, not yet on any list.
+func newNode(label string) *node {
+	lastNodeId++
+	return &node{
+		id:      lastNodeId,
+		label:   label,
+		sublist: make([]*node, 0),
+	}
 }
 
 func (n *node) insertKid(pos int, newkid *node) {
@@ -19,6 +88,18 @@ func (n *node) insertKid(pos int, newkid *node) {
 	copy(n.sublist[pos+1:], n.sublist[pos:])
 	n.sublist[pos] = newkid
 	newkid.parent = n
+	touchMount(n)
+	indexFor(n).addTree(newkid)
+}
+
+// Returns position of 'kid' on list of n, or -1 if not there.
+func (n *node) indexOf(kid *node) int {
+	for i, k := range n.sublist {
+		if k == kid {
+			return i
+		}
+	}
+	return -1
 }
 
 func (n *node) removeKid(pos int) *node {
@@ -26,11 +107,89 @@ func (n *node) removeKid(pos int) *node {
 		return nil
 	}
 	r := n.sublist[pos]
+	indexFor(n).removeTree(r)
 	n.sublist = append(n.sublist[:pos], n.sublist[pos+1:]...)
 	r.parent = nil
+	touchMount(n)
 	return r
 }
 
+// Returns a copy of the tree rooted at n, made of fresh nodes. The copy is not
+// on any list, and is not tagged. Files mounted are mounted again, not copied.
+func (n *node) copyTree() *node {
+	c := newNode("")
+	c.copyContent(n)
+	if n.mount != nil {
+		return c
+	}
+	for _, kid := range n.sublist {
+		c.insertKid(len(c.sublist), kid.copyTree())
+	}
+	return c
+}
+
+// Makes n carry the same label, note, dates etc. as 'from'; all but its place
+// in the tree, its sublist and its id.
+func (n *node) copyContent(from *node) {
+	n.label = from.label
+	n.note = from.note
+	n.due = from.due
+	n.scheduled = from.scheduled
+	n.repeat = from.repeat
+	n.priority = from.priority
+	n.query = from.query
+	n.link = from.link
+	n.mount = nil
+	if from.mount != nil {
+		n.mount = newMount(from.mount.path)
+	}
+}
+
+// Returns the chain of nodes from the root down to (and including) n.
+func (n *node) ancestry() []*node {
+	path := []*node{}
+	for p := n; p != nil; p = p.parent {
+		path = append(path, p)
+	}
+	// Reverse, so that root comes first.
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Returns labels on the path from below root down to n, for showing where an
+// item is located.
+func (n *node) pathString() string {
+	labels := []string{}
+	for _, p := range n.ancestry()[1:] {
+		labels = append(labels, p.label)
+	}
+	return strings.Join(labels, sepCrumb)
+}
+
+// Returns all nodes of the tree rooted at n, in depth first order (parents
+// before their kids). Items not part of the tree are left out, as are those of
+// files mounted (but not the items mounting them).
+func (n *node) preorder() []*node {
+	return n.appendPreorder(nil)
+}
+
+// Appends nodes of the tree rooted at n to 'nodes', as preorder() returns
+// them; in one go, rather than level by level.
+func (n *node) appendPreorder(nodes []*node) []*node {
+	nodes = append(nodes, n)
+	if n.mount != nil {
+		return nodes
+	}
+	for _, kid := range n.sublist {
+		if kid.enter == nil {
+			nodes = kid.appendPreorder(nodes)
+		}
+	}
+	return nodes
+}
+
 // Returns number of nodes in tree, and its max depth.
 func (n *node) Analyze() (int, int) {
 	// Start off by counting self.
@@ -0,0 +1,244 @@
+package main
+
+// Plain text "outline" form of (parts of) the tree: one item per line, with
+// sublists indented below their item. Used for editing in an external
+// editor.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Lines starting with this are comments, ignored when parsing.
+const OUTLINE_COMMENT = "#|"
+
+// An item as parsed from outline text.
+type outlineItem struct {
+	label string
+	kids  []*outlineItem
+}
+
+// Writes out 'nodes' and everything below them, indented by 'depth' tabs.
+// Links are written as just the label of their item; files mounted, as just
+// the item mounting them.
+func writeOutline(w io.Writer, nodes []*node, depth int) {
+	for _, n := range nodes {
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat("\t", depth), n.resolve().label)
+		if n.mount == nil {
+			writeOutline(w, n.sublist, depth+1)
+		}
+	}
+}
+
+// Parses outline text back into items. Any consistent indentation works
+// (tabs or spaces), but going back out must return to a level used before.
+func parseOutline(text string) ([]*outlineItem, error) {
+	// Items not yet closed, along with their indentation. At the bottom is
+	// a stand-in parent for top level items.
+	stack := []*outlineItem{&outlineItem{}}
+	indents := []int{-1}
+
+	for i, l := range strings.Split(text, "\n") {
+		l = strings.TrimRight(l, whitespace)
+		label := strings.TrimLeft(l, whitespace)
+		if label == "" || strings.HasPrefix(label, OUTLINE_COMMENT) {
+			continue
+		}
+		indent := len(l) - len(label)
+
+		// Unless indented deeper than the item above (making it a kid
+		// of that item), close items until reaching a sibling.
+		if indent <= indents[len(indents)-1] {
+			for indent < indents[len(indents)-1] {
+				stack = stack[:len(stack)-1]
+				indents = indents[:len(indents)-1]
+			}
+			if indent != indents[len(indents)-1] {
+				return nil, fmt.Errorf(
+					"line %d: indentation matches no outer level", i+1)
+			}
+			stack = stack[:len(stack)-1]
+			indents = indents[:len(indents)-1]
+		}
+		item := &outlineItem{label, nil}
+		parent := stack[len(stack)-1]
+		parent.kids = append(parent.kids, item)
+		stack = append(stack, item)
+		indents = append(indents, indent)
+	}
+	return stack[0].kids, nil
+}
+
+// Lets the user edit 'nodes' as an outline, in $EDITOR, and returns the
+// result. Must be run while the GUI is suspended. On parse errors the
+// editor is offered again, so that no edits get lost.
+func editOutline(nodes []*node) ([]*outlineItem, error) {
+	f, err := ioutil.TempFile("", "loled-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%s Indent to nest items. Lines starting with %q are ignored.\n",
+		OUTLINE_COMMENT, OUTLINE_COMMENT)
+	writeOutline(f, nodes, 0)
+	f.Close()
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+
+	for {
+		cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("running %q: %v (edits kept in %s)",
+				editor[0], err, f.Name())
+		}
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			return nil, err
+		}
+		items, err := parseOutline(string(data))
+		if err == nil {
+			os.Remove(f.Name())
+			return items, nil
+		}
+
+		// Point out the problem at the top of the file, and offer it
+		// for editing again.
+		lines := []string{fmt.Sprintf("%s ERROR: %v", OUTLINE_COMMENT, err)}
+		for _, l := range strings.Split(string(data), "\n") {
+			if !strings.HasPrefix(l, OUTLINE_COMMENT+" ERROR:") {
+				lines = append(lines, l)
+			}
+		}
+		ioutil.WriteFile(f.Name(), []byte(strings.Join(lines, "\n")), 0600)
+		fmt.Printf("%v\nPress Enter to edit again, or q to give up: ", err)
+		if strings.HasPrefix(readString(), "q") {
+			return nil, fmt.Errorf("%v (edits kept in %s)", err, f.Name())
+		}
+	}
+}
+
+// Replaces 'old' items, found at 'pos' on list 'parent', with the edited
+// 'items'. Items whose label is unchanged keep their node (and so their note,
+// Targets pointing at them, etc.). Nodes left over go to Trash. Undoable.
+func (ds *dataStore) replaceWithOutline(parent *node, pos int, old []*node, items []*outlineItem) {
+	// Old nodes available for reuse, by label, in depth first order.
+	oldNodes := []*node{}
+	for _, n := range old {
+		oldNodes = append(oldNodes, n.preorder()...)
+	}
+	unused := make(map[string][]*node)
+	for _, n := range oldNodes {
+		unused[n.resolve().label] = append(unused[n.resolve().label], n)
+	}
+
+	// Match items to nodes in the same order they were written out, so
+	// that repeated labels pair up as expected.
+	nodeFor := make(map[*outlineItem]*node)
+	reused := make(map[*node]bool)
+	// Set to a link or mount given items below it, which would not show:
+	// its sublist is that of another item, or of another file.
+	var notOwnKids *node
+	var match func(items []*outlineItem)
+	match = func(items []*outlineItem) {
+		for _, item := range items {
+			if c := unused[item.label]; len(c) > 0 {
+				nodeFor[item], unused[item.label] = c[0], c[1:]
+				reused[c[0]] = true
+			} else {
+				nodeFor[item] = newNode(item.label)
+			}
+			if n := nodeFor[item]; (n.link != nil || n.mount != nil) && len(item.kids) > 0 {
+				notOwnKids = n
+			}
+			match(item.kids)
+		}
+	}
+	match(items)
+	if notOwnKids != nil {
+		Log("Edit discarded: items cannot go below %q here; edit the item it stands for.",
+			notOwnKids.resolve().label)
+		return
+	}
+
+	removed := make(map[*node]bool)
+	for _, n := range oldNodes {
+		if reused[n] {
+			continue
+		}
+		if ds.isFileList(n) || n.enter != nil {
+			Log("Edit discarded: %q cannot be removed.", n.label)
+			return
+		}
+		removed[n] = true
+	}
+
+	_, trash := ds.fileLists(parent)
+	ds.saveUndo("external edit", append([]*node{parent, trash.list}, oldNodes...)...)
+
+	// Swap old items for rebuilt ones.
+	for range old {
+		parent.removeKid(pos)
+	}
+	var build func(items []*outlineItem) []*node
+	build = func(items []*outlineItem) []*node {
+		nodes := []*node{}
+		for _, item := range items {
+			n := nodeFor[item]
+			nodes = append(nodes, n)
+			if n.mount != nil {
+				// Its file is left as it is.
+				continue
+			}
+			n.sublist = []*node{}
+			for _, kid := range build(item.kids) {
+				n.insertKid(len(n.sublist), kid)
+			}
+		}
+		return nodes
+	}
+	for i, n := range build(items) {
+		parent.insertKid(pos+i, n)
+	}
+
+	// Whatever was not reused goes to Trash; only the topmost of those,
+	// taking along any others below them.
+	for _, n := range oldNodes {
+		if !removed[n] || removed[n.parent] {
+			continue
+		}
+		if n.mount == nil {
+			kids := []*node{}
+			for _, kid := range n.sublist {
+				if removed[kid] {
+					kids = append(kids, kid)
+				}
+			}
+			n.sublist = kids
+		}
+		trash.insert(n)
+		Log("Moved removed item %q to Trash.", n.label)
+	}
+
+	ds.currentList = parent
+	if ds.indexOfItem(ds.currentItem) < 0 {
+		ds.currentItem = nil
+		if len(parent.sublist) > 0 {
+			ds.currentItem = parent.sublist[min(pos, len(parent.sublist)-1)]
+		}
+	}
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(ds.currentItem))
+	ds.reindex()
+	ds.changedList(parent)
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestOutlineKidsOfLinkRefused(t *testing.T) {
+	b := testBuffer(t, "a", "b")
+	a := itemsLabelled(b.root, "a")[0]
+	b.setCurrentItemUsingIndex(b.root.indexOf(a))
+	b.SetUserTarget()
+	b.LinkCurrentItemAtTarget(b.Mark)
+	l := b.root.sublist[b.root.indexOf(a)+1]
+	if l.link != a {
+		t.Fatal("no link made")
+	}
+
+	items, err := parseOutline("a\n\tnew kid\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.replaceWithOutline(b.root, b.root.indexOf(l), []*node{l}, items)
+	if len(l.sublist) != 0 || len(a.sublist) != 0 {
+		t.Errorf("kids added: %q below link, %q below item", labelsOf(l), labelsOf(a))
+	}
+
+	// Items of its own are fine.
+	bn := itemsLabelled(b.root, "b")[0]
+	items, _ = parseOutline("b\n\tnew kid\n")
+	b.replaceWithOutline(b.root, b.root.indexOf(bn), []*node{bn}, items)
+	if got := labelsOf(bn); len(got) != 1 || got[0] != "new kid" {
+		t.Errorf("kids of b: %q", got)
+	}
+}
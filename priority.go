@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Priorities go from 1 (highest) to PRIORITY_LOWEST; 0 means none set. They
+// are shown as letters, A being highest.
+const PRIORITY_LOWEST = 5
+
+// Colors priorities are shown in, highest first.
+var priorityColors = []int{FG_RED, FG_YELLOW, FG_GREEN, FG_CYAN, FG_WHITE}
+
+// Parses priority given as a digit (1-5) or letter (A-E); '0' or '-' mean no
+// priority.
+func parsePriority(ch rune) (int, bool) {
+	switch {
+	case ch == '0' || ch == '-':
+		return 0, true
+	case ch >= '1' && ch <= '0'+PRIORITY_LOWEST:
+		return int(ch - '0'), true
+	case ch >= 'a' && ch < 'a'+PRIORITY_LOWEST:
+		return int(ch-'a') + 1, true
+	case ch >= 'A' && ch < 'A'+PRIORITY_LOWEST:
+		return int(ch-'A') + 1, true
+	}
+	return 0, false
+}
+
+func priorityLetter(p int) string {
+	return string(rune('A' + p - 1))
+}
+
+// Returns display prefix for priority of 'n', if it has one.
+func priorityPrefix(n *node) string {
+	if n.priority == 0 {
+		return ""
+	}
+	return colorString("("+priorityLetter(n.priority)+")", priorityColors[n.priority-1],
+		BG_BLACK, ";1") + " "
+}
+
+// Orders by priority, highest first; items without priority come last.
+func byPriority(a, b *node) bool {
+	pa, pb := a.resolve().priority, b.resolve().priority
+	if pa == 0 {
+		pa = PRIORITY_LOWEST + 1
+	}
+	if pb == 0 {
+		pb = PRIORITY_LOWEST + 1
+	}
+	return pa < pb
+}
+
+func (ds *dataStore) setPriority(p int) {
+	if ds.currentItem == nil {
+		return
+	}
+	n := ds.currentItem.resolve()
+	n.priority = p
+	ds.changedList(n.parent)
+}
+
+// Returns items among 'nodes' with priority 'p' or higher; for 'p' of 0, only
+// those with the highest priority found. Highest priority items come first.
+func withPriority(nodes []*node, p int) []*node {
+	if p == 0 {
+		p = PRIORITY_LOWEST
+		for _, n := range nodes {
+			if n.priority > 0 && n.priority < p {
+				p = n.priority
+			}
+		}
+	}
+	items := []*node{}
+	for _, n := range nodes {
+		if n.priority > 0 && n.priority <= p {
+			items = append(items, n)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return byPriority(items[i], items[j])
+	})
+	return items
+}
+
+// Shows items of current list with priority 'p' or higher (see
+// withPriority()).
+func (ds *dataStore) filterByPriority(p int) {
+	items := withPriority(ds.currentList.sublist, p)
+	ds.enterView(fmt.Sprintf("[%s by priority]", ds.currentList.label), items, nil)
+}
+
+// Shows open items from the whole tree with priority 'p' or higher (see
+// withPriority()), along with where they are.
+func (ds *dataStore) showTopPriorities(p int) {
+	items := withPriority(ds.openItems(), p)
+	ds.enterView("[top priorities]", items, describeWithPath)
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,262 @@
+package main
+
+// Queries select items from all over the tree. Nodes carrying a query act as
+// "smart lists": their items are whatever the query currently finds.
+//
+// A query is made of terms, all of which an item must match:
+//   word          label contains word (ignoring case)
+//   re:REGEX      label matches regular expression
+//   #tag, @tag    item has tag
+//   due:A..B      due date within range; either end may be left out, and a
+//                 single date means that day (dates as in parseDate())
+//   depth:A..B    depth within range (1 being top level); or a single depth
+//   under:LABEL   item is below one labelled LABEL (ignoring case)
+//   prio:P        priority P (A-E or 1-5) or higher
+//   done:no       not DONE (default); also done:only, done:any
+// Terms containing spaces can be quoted, e.g. under:"side projects". Items
+// in Trash are never found.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QUERY_DONE_NO = iota
+	QUERY_DONE_ONLY
+	QUERY_DONE_ANY
+)
+
+// A parsed query.
+type query struct {
+	words    []string
+	regexes  []*regexp.Regexp
+	tags     []string
+	dueFrom  time.Time // zero if open ended
+	dueTo    time.Time // zero if open ended
+	hasDue   bool      // whether there is a due term at all
+	depthMin int
+	depthMax int // 0 if open ended
+	under    []string
+	priority int // 0 if any
+	done     int // one of QUERY_DONE_*
+}
+
+// Splits 's' on whitespace, except within double quotes (which are dropped).
+func splitQuoted(s string) []string {
+	terms := []string{}
+	term := ""
+	inQuotes, inTerm := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inTerm = true
+		case strings.ContainsRune(whitespace, r) && !inQuotes:
+			if inTerm {
+				terms = append(terms, term)
+			}
+			term, inTerm = "", false
+		default:
+			term += string(r)
+			inTerm = true
+		}
+	}
+	if inTerm {
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// Splits range "A..B" into its ends; a lone "A" is both ends.
+func splitRange(s string) (string, string) {
+	if i := strings.Index(s, ".."); i >= 0 {
+		return s[:i], s[i+2:]
+	}
+	return s, s
+}
+
+func parseQuery(s string, today time.Time) (*query, error) {
+	q := &query{}
+	for _, term := range splitQuoted(s) {
+		if tag, ok := parseTag(term); ok {
+			q.tags = append(q.tags, tag)
+			continue
+		}
+		kv := strings.SplitN(term, ":", 2)
+		if len(kv) < 2 {
+			q.words = append(q.words, strings.ToLower(term))
+			continue
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "re":
+			var re *regexp.Regexp
+			if re, err = regexp.Compile(value); err == nil {
+				q.regexes = append(q.regexes, re)
+			}
+		case "due":
+			from, to := splitRange(value)
+			q.hasDue = true
+			if from != "" {
+				q.dueFrom, err = parseDate(from, today)
+			}
+			if to != "" && err == nil {
+				q.dueTo, err = parseDate(to, today)
+			}
+		case "depth":
+			from, to := splitRange(value)
+			if q.depthMin, err = strconv.Atoi(from); err == nil && to != "" {
+				q.depthMax, err = strconv.Atoi(to)
+			}
+		case "under":
+			q.under = append(q.under, strings.ToLower(value))
+		case "prio":
+			var ok bool
+			if len(value) != 1 {
+				err = fmt.Errorf("bad priority %q", value)
+			} else if q.priority, ok = parsePriority(rune(value[0])); !ok {
+				err = fmt.Errorf("bad priority %q", value)
+			}
+		case "done":
+			switch value {
+			case "no":
+				q.done = QUERY_DONE_NO
+			case "only":
+				q.done = QUERY_DONE_ONLY
+			case "any":
+				q.done = QUERY_DONE_ANY
+			default:
+				err = fmt.Errorf("done: must be one of no, only, any")
+			}
+		default:
+			// Not a known term; just a word with a colon in it.
+			q.words = append(q.words, strings.ToLower(term))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("in %q: %v", term, err)
+		}
+	}
+	return q, nil
+}
+
+// Whether 'n', found at 'depth' below 'ancestors', matches. Ancestors are
+// listed from root down, and include whether n is in DONE.
+func (q *query) matches(n *node, depth int, ancestors []*node, inDone bool) bool {
+	label := strings.ToLower(n.label)
+	for _, w := range q.words {
+		if !strings.Contains(label, w) {
+			return false
+		}
+	}
+	for _, re := range q.regexes {
+		if !re.MatchString(n.label) {
+			return false
+		}
+	}
+	for _, tag := range q.tags {
+		if !n.hasTag(tag) {
+			return false
+		}
+	}
+	if q.hasDue {
+		if n.due.IsZero() ||
+			(!q.dueFrom.IsZero() && n.due.Before(q.dueFrom)) ||
+			(!q.dueTo.IsZero() && n.due.After(q.dueTo)) {
+			return false
+		}
+	}
+	if depth < q.depthMin || (q.depthMax > 0 && depth > q.depthMax) {
+		return false
+	}
+	for _, u := range q.under {
+		found := false
+		for _, a := range ancestors {
+			if strings.ToLower(a.label) == u {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.priority > 0 && (n.priority == 0 || n.priority > q.priority) {
+		return false
+	}
+	switch q.done {
+	case QUERY_DONE_NO:
+		return !inDone
+	case QUERY_DONE_ONLY:
+		return inDone
+	}
+	return true
+}
+
+// Returns items of the tree matching 'q', in depth first order. Files mounted
+// are left out.
+func (ds *dataStore) queryItems(q *query) []*node {
+	items := []*node{}
+	ancestors := []*node{}
+	var walk func(n *node, depth int, inDone bool)
+	walk = func(n *node, depth int, inDone bool) {
+		ancestors = append(ancestors, n)
+		for _, kid := range n.sublist {
+			if kid == ds.markTrash.list || kid.link != nil {
+				// Links would only find their items a second time.
+				continue
+			}
+			kidInDone := inDone || kid == ds.markDone.list
+			if kid != ds.markDone.list && q.matches(kid, depth+1, ancestors, kidInDone) {
+				items = append(items, kid)
+			}
+			if kid.mount == nil {
+				walk(kid, depth+1, kidInDone)
+			}
+		}
+		ancestors = ancestors[:len(ancestors)-1]
+	}
+	walk(ds.root, 0, false)
+	return items
+}
+
+// Shows what the query of smart list 'n' currently finds.
+func (ds *dataStore) showQueryResults(n *node) {
+	q, err := parseQuery(n.query, today())
+	if err != nil {
+		Log("Bad query for %q: %v.", n.label, err)
+		return
+	}
+	ds.enterView(n.label, ds.queryItems(q), describeWithPath)
+}
+
+// Sets the query of current item, if it is a smart list; else adds a new smart
+// list with the query. Empty query turns a smart list back into an ordinary
+// item.
+func (ds *dataStore) setQuery(s string) {
+	s = strings.Trim(s, whitespace)
+	if s != "" {
+		if _, err := parseQuery(s, today()); err != nil {
+			Log("Bad query: %v.", err)
+			return
+		}
+	}
+	n := ds.currentItem
+	if n != nil {
+		n = n.resolve()
+	}
+	if n == nil || n.query == "" {
+		if s == "" {
+			return
+		}
+		n = ds.appendItem("[" + s + "]")
+	}
+	n.query = s
+	ds.changedList(n.parent)
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,179 @@
+package main
+
+// References to other items, embedded in labels (or notes), e.g. "see
+// [[id:42]]". Besides by id, an item can be referred to by its path of labels
+// below root, e.g. "[[Work/Project X]]" (ignoring case).
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	REF_PREFIX_ID = "id:"
+	REF_SEP_PATH  = "/"
+)
+
+var refPattern = regexp.MustCompile(`\[\[([^\[\]]+)\]\]`)
+
+// Returns the references in 's', each without its brackets.
+func findRefs(s string) []string {
+	refs := []string{}
+	if !strings.Contains(s, "[[") {
+		// As for most; far cheaper than the regexp.
+		return refs
+	}
+	for _, m := range refPattern.FindAllStringSubmatch(s, -1) {
+		refs = append(refs, m[1])
+	}
+	return refs
+}
+
+// Whether 'label' is that of a special list or placeholder, which looks like
+// a reference but is not one.
+func isSpecialLabel(label string) bool {
+	switch label {
+	case LABEL_DONE, LABEL_TRASH, LABEL_RECENT:
+		return true
+	}
+	return strings.HasPrefix(label, LABEL_NOT_LOADED)
+}
+
+// Returns the references in the label of 'n'.
+func labelRefs(n *node) []string {
+	if isSpecialLabel(n.label) {
+		return []string{}
+	}
+	return findRefs(n.label)
+}
+
+// Returns the references in the label and note of 'n'.
+func itemRefs(n *node) []string {
+	return append(labelRefs(n), findRefs(n.note)...)
+}
+
+// Returns reference to 'n', for embedding in labels.
+func refTo(n *node) string {
+	return "[[" + REF_PREFIX_ID + strconv.Itoa(n.id) + "]]"
+}
+
+// Returns the id reference 'ref' (without its brackets) is to; false if it
+// is not one.
+func parseIdRef(ref string) (int, bool) {
+	if !strings.HasPrefix(ref, REF_PREFIX_ID) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(ref[len(REF_PREFIX_ID):])
+	return id, err == nil
+}
+
+// Returns the item 'ref' (without its brackets) refers to, or nil if none.
+func (ds *dataStore) resolveRef(ref string) *node {
+	if strings.HasPrefix(ref, REF_PREFIX_ID) {
+		id, ok := parseIdRef(ref)
+		if !ok || id == 0 {
+			return nil
+		}
+		return ds.nodeById(id)
+	}
+	n := ds.root
+	for _, label := range strings.Split(ref, REF_SEP_PATH) {
+		var next *node
+		for _, kid := range n.resolve().sublist {
+			if strings.EqualFold(kid.resolve().label, strings.TrimSpace(label)) {
+				next = kid
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n.resolve()
+}
+
+// Returns the label of 'n' with references replaced by the label of what they
+// refer to, for display.
+func (ds *dataStore) expandRefs(n *node) string {
+	if isSpecialLabel(n.label) {
+		return n.label
+	}
+	return refPattern.ReplaceAllStringFunc(n.label, func(m string) string {
+		if n := ds.resolveRef(m[2 : len(m)-2]); n != nil {
+			return "[[" + n.label + "]]"
+		}
+		return m
+	})
+}
+
+// Goes to the item referred to by the 'nth' (from 0) reference in the label
+// of current item, or if it has none there, in its note.
+func (ds *dataStore) followRef(nth int) {
+	if ds.currentItem == nil {
+		return
+	}
+	item := ds.currentItem.resolve()
+	refs := labelRefs(item)
+	if len(refs) == 0 {
+		refs = findRefs(item.note)
+	}
+	if len(refs) == 0 {
+		Log("No references in current item.")
+		return
+	}
+	if nth >= len(refs) {
+		Log("Only %d reference(s) in current item.", len(refs))
+		return
+	}
+	n := ds.resolveRef(refs[nth])
+	if n == nil {
+		Log("Nothing found for reference [[%s]].", refs[nth])
+		return
+	}
+	ds.goToNode(n)
+}
+
+// Returns items whose label or note refers to 'n'.
+func (ds *dataStore) backlinks(n *node) []*node {
+	n = n.resolve()
+	items := []*node{}
+	for _, m := range ds.root.preorder() {
+		for _, ref := range itemRefs(m) {
+			// Cheap check for id references, which are the common kind.
+			isId := strings.HasPrefix(ref, REF_PREFIX_ID)
+			id, _ := parseIdRef(ref)
+			if (isId && id == n.id) || (!isId && ds.resolveRef(ref) == n) {
+				items = append(items, m)
+				break
+			}
+		}
+	}
+	return items
+}
+
+// Whether the label or note of 'm' refers to 'n' by path.
+func (ds *dataStore) refersByPath(m, n *node) bool {
+	for _, ref := range itemRefs(m) {
+		if !strings.HasPrefix(ref, REF_PREFIX_ID) && ds.resolveRef(ref) == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Shows items referring to current item.
+func (ds *dataStore) showBacklinks() {
+	if ds.currentItem == nil {
+		return
+	}
+	items := ds.backlinks(ds.currentItem)
+	if len(items) == 0 {
+		Log("Nothing refers to %q.", ds.currentItem.resolve().label)
+		return
+	}
+	ds.enterView("Backlinks: "+ds.currentItem.resolve().label, items, describeWithPath)
+}
+
+// vim: fdm=syntax
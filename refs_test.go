@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestSpecialListsAreNotRefs(t *testing.T) {
+	b := testBuffer(t, "done", "trash", "see [[done]]")
+	var done *node
+	for _, n := range b.root.sublist {
+		if n.label == "done" {
+			done = n
+		}
+	}
+	if k := len(b.backlinks(done)); k != 1 {
+		t.Errorf("backlinks: %d, want 1", k)
+	}
+	if k := b.backlinkCount(done); k != 1 {
+		t.Errorf("backlinkCount: %d, want 1", k)
+	}
+	if s := b.expandRefs(b.markDone.list); s != LABEL_DONE {
+		t.Errorf("label of DONE shown as %q", s)
+	}
+	p := newNode(LABEL_NOT_LOADED + "no such file]]")
+	if refs := itemRefs(p); len(refs) != 0 {
+		t.Errorf("refs of placeholder: %q", refs)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Words in labels starting with any of these are tags, e.g. "#work" or
+// "@home".
+const TAG_SIGILS = "#@"
+
+// Trailing punctuation not considered part of a tag.
+const TAG_TRAILING_PUNCT = ".,;:!?)"
+
+// Returns tag if 'word' is one, in canonical (lower case) form.
+func parseTag(word string) (string, bool) {
+	word = strings.TrimRight(word, TAG_TRAILING_PUNCT)
+	r := []rune(word)
+	if len(r) < 2 || !strings.ContainsRune(TAG_SIGILS, r[0]) || !unicode.IsLetter(r[1]) {
+		return "", false
+	}
+	return strings.ToLower(word), true
+}
+
+// Returns tags found in label of 'n', without repeats.
+func (n *node) tags() []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(n.label) {
+		if tag, ok := parseTag(word); ok && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (n *node) hasTag(tag string) bool {
+	for _, t := range n.tags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces tags in label of current item with those in 'spec'.
+func (ds *dataStore) setTags(spec string) {
+	if ds.currentItem == nil {
+		return
+	}
+	n := ds.currentItem.resolve()
+	words := []string{}
+	for _, word := range strings.Fields(n.label) {
+		if _, ok := parseTag(word); !ok {
+			words = append(words, word)
+		}
+	}
+	for _, word := range strings.Fields(spec) {
+		if _, ok := parseTag(word); !ok {
+			Log("Not a tag: %q (must start with one of %q).", word, TAG_SIGILS)
+			return
+		}
+		words = append(words, word)
+	}
+	changeItem(n, func() { n.label = strings.Join(words, " ") })
+	ds.changedList(n.parent)
+}
+
+// Shows every tag used on open items, with how many items have it. Entering a
+// tag shows those items.
+func (ds *dataStore) showTags() {
+	count := make(map[string]int)
+	for _, n := range ds.openItems() {
+		for _, tag := range n.tags() {
+			count[tag]++
+		}
+	}
+	names := []string{}
+	for tag := range count {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+
+	// Stand-ins for tags; they are not part of the tree.
+	items := []*node{}
+	for _, tag := range names {
+		items = append(items, newNode(tag))
+	}
+	ds.enterView("[tags]", items, func(n *node) string {
+		return fmt.Sprintf("%s (%d)", n.label, count[n.label])
+	})
+	ds.currentList.view.open = func(n *node) {
+		ds.showTagged(n.label)
+	}
+}
+
+// Shows open items having 'tag', along with where they are.
+func (ds *dataStore) showTagged(tag string) {
+	items := []*node{}
+	for _, n := range ds.openItems() {
+		if n.hasTag(tag) {
+			items = append(items, n)
+		}
+	}
+	ds.enterView("["+tag+"]", items, describeWithPath)
+}
+
+// vim: fdm=syntax
@@ -0,0 +1,115 @@
+package main
+
+// How many operations can be undone.
+const UNDO_MAX_STEPS = 100
+
+// Enough state to reverse an operation which rearranged items, without
+// creating or changing any of them: the former contents of every list it
+// touched, plus where the cursor was. Operations which do change items a
+// little (or move Target) record that too.
+type undoStep struct {
+	// Shown to user on undo.
+	desc string
+	// Former sublists, keyed by the node owning them.
+	lists map[*node][]*node
+
+	currentList *node
+	currentItem *node
+
+	// Former tagged flags of items, if the operation may change them.
+	tagged map[*node]bool
+	// Former Target, if it was moved; nil if not.
+	mark *Target
+}
+
+// Records lists about to be changed by operation 'desc', so it can be undone
+// later. Must be called before making any changes.
+func (ds *dataStore) saveUndo(desc string, lists ...*node) {
+	step := undoStep{
+		desc:        desc,
+		lists:       make(map[*node][]*node),
+		currentList: ds.currentList,
+		currentItem: ds.currentItem,
+	}
+	for _, l := range lists {
+		if _, ok := step.lists[l]; ok {
+			continue
+		}
+		// Copy, since operations are free to reuse the backing array.
+		step.lists[l] = append([]*node(nil), l.sublist...)
+	}
+	ds.undo = append(ds.undo, step)
+	if len(ds.undo) > UNDO_MAX_STEPS {
+		ds.undo = ds.undo[1:]
+	}
+}
+
+// Forgets all operations recorded, for one which rearranges lists without
+// recording it: undoing those would put back lists the tree no longer
+// matches.
+func (ds *dataStore) forgetUndo() {
+	ds.undo = nil
+}
+
+// Returns items on 'a' which are not on 'b'.
+func listMinus(a, b []*node) []*node {
+	onB := make(map[*node]bool, len(b))
+	for _, n := range b {
+		onB[n] = true
+	}
+	items := []*node{}
+	for _, n := range a {
+		if !onB[n] {
+			items = append(items, n)
+		}
+	}
+	return items
+}
+
+// Reverses the most recent undoable operation.
+func (ds *dataStore) Undo() {
+	if len(ds.undo) == 0 {
+		Log("Nothing to undo.")
+		return
+	}
+	step := ds.undo[len(ds.undo)-1]
+	ds.undo = ds.undo[:len(ds.undo)-1]
+
+	// Items leaving the tree are taken out of its index before, and those
+	// coming back put in after. Those leaving for good are left with no
+	// parent, as by removeKid().
+	lists := make(map[*node][]*node)
+	for l, kids := range step.lists {
+		lists[l] = l.sublist
+		for _, kid := range listMinus(l.sublist, kids) {
+			indexFor(l).removeTree(kid)
+			kid.parent = nil
+		}
+	}
+	for l, kids := range step.lists {
+		l.sublist = kids
+		for _, kid := range kids {
+			kid.parent = l
+		}
+		touchMount(l)
+	}
+	for l, kids := range step.lists {
+		for _, kid := range listMinus(kids, lists[l]) {
+			indexFor(l).addTree(kid)
+		}
+	}
+	for n, tagged := range step.tagged {
+		n.tagged = tagged
+	}
+	if step.mark != nil {
+		*ds.Mark = *step.mark
+	}
+	ds.currentList = step.currentList
+	ds.currentItem = step.currentItem
+	ds.setCurrentItemUsingIndex(ds.indexOfItem(step.currentItem))
+
+	ds.dirty = true
+	Log("Undid %s.", step.desc)
+}
+
+// vim: fdm=syntax
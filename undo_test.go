@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Returns a new buffer, made current, with items labelled 'labels'.
+func testBuffer(t *testing.T, labels ...string) *dataStore {
+	t.Helper()
+	ds = &dataStore{filename: t.TempDir() + "/test.lol"}
+	ds.init()
+	for _, s := range labels {
+		ds.appendItem(s)
+	}
+	return ds
+}
+
+// Saves the tree of 'b' and loads it back.
+func testReload(t *testing.T, b *dataStore) fileTree {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := b.tree().write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	tree, err := parseTree(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, buf.Bytes())
+	}
+	return tree
+}
+
+func labelsOf(l *node) []string {
+	s := []string{}
+	for _, n := range l.sublist {
+		s = append(s, n.label)
+	}
+	return s
+}
+
+func TestUndoSort(t *testing.T) {
+	b := testBuffer(t, "c", "a", "b")
+	b.sortItems(byLabel, false, false)
+	b.Undo()
+	got := labelsOf(testReload(t, b).root)
+	want := []string{"c", "a", "b", LABEL_DONE, LABEL_TRASH}
+	if len(got) < 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("after undo: %q, want %q", got, want)
+	}
+}
+
+func TestUndoAfterMove(t *testing.T) {
+	tests := []struct {
+		name string
+		move func(b *dataStore)
+	}{
+		{"done", func(b *dataStore) { b.MoveCurrentItemToTarget(b.markDone) }},
+		{"trash", func(b *dataStore) { b.MoveCurrentItemToTarget(b.markTrash) }},
+		{"append", func(b *dataStore) { b.appendItem("d") }},
+		{"fold", func(b *dataStore) {
+			b.currentItem.tagged = true
+			b.foldTaggedItemsUnder("fold")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBuffer(t, "c", "a", "b")
+			b.sortItems(byLabel, false, false)
+			for i, n := range b.root.sublist {
+				if n.label == "a" {
+					b.setCurrentItemUsingIndex(i)
+				}
+			}
+			tt.move(b)
+			b.Undo()
+
+			tree := testReload(t, b)
+			seen := make(map[string]int)
+			for _, n := range tree.root.preorder() {
+				seen[n.label]++
+			}
+			for _, s := range []string{"a", "b", "c"} {
+				if seen[s] != 1 {
+					t.Errorf("%q is in the tree %d times", s, seen[s])
+				}
+			}
+		})
+	}
+}
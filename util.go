@@ -2,16 +2,47 @@ package main
 
 import (
 	"bufio"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
+// Reads a line from stdin. Lines may end in either '\r' (as when the
+// terminal is still in raw mode) or '\n'.
 func readString() string {
 	reader := bufio.NewReader(os.Stdin)
-	text, _ := reader.ReadString('\r')
-	if text[len(text)-1] == '\n' || text[len(text)-1] == '\r' {
-		text = text[:len(text)-1]
+	text := ""
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil || r == '\r' || r == '\n' {
+			return text
+		}
+		text += string(r)
 	}
-	return text
+}
+
+// Writes 'data' to file 'path' as a whole: to a file aside first, then
+// renamed into place, so that no one (a crash included) finds it half
+// written. An existing file keeps its permissions; a new one gets 'perm'.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	tmp := path + ".new"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// WriteFile leaves permissions of a file already there as they were.
+	os.Chmod(tmp, perm)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 func min(a, b int) int {
@@ -41,4 +72,21 @@ func pushBack(l *[]string, s string) {
 	*l = append(*l, s)
 }
 
+// NOTE: counts runes, not bytes (because of Unicode multibyte runes).
+func runeLen(s string) int {
+	return len([]rune(s))
+}
+
+// Shortens s to at most width runes, marking the cut with an ellipsis.
+func truncateString(s string, width int) string {
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	if width < 1 {
+		return ""
+	}
+	return string(r[:width-1]) + "…"
+}
+
 // vim: fdm=syntax
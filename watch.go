@@ -0,0 +1,169 @@
+package main
+
+// Watching the file for changes made by others (another loled, a script, a
+// git checkout) while it is being edited. These are noticed by polling, and
+// then rather than either side's changes getting lost on the next save or
+// load, the user gets to pick: reload theirs, keep (save) ours, or merge the
+// two as "loled merge" would.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+// How often to check the file for changes.
+const WATCH_INTERVAL = 2 * time.Second
+
+// What is known of the file on disk.
+type diskState struct {
+	// Modification time and size when last looked at.
+	modTime time.Time
+	size    int64
+	// Contents as last loaded or saved; base for merging.
+	data []byte
+	// Whether it has changed since, to contents other than 'data'.
+	changed bool
+}
+
+// Notes that file 'path' (now) has contents 'data'.
+func (d *diskState) saw(path string, data []byte) {
+	d.data = data
+	d.changed = false
+	if fi, err := os.Stat(path); err == nil {
+		d.modTime, d.size = fi.ModTime(), fi.Size()
+	}
+}
+
+// Checks whether file has changed on disk, letting user know the first time
+// it is found to have.
+func (ds *dataStore) checkDisk() {
+	d := &ds.disk
+	if d.changed || d.data == nil {
+		// Already known, or there is no file yet that we know of.
+		return
+	}
+	fi, err := os.Stat(ds.filename)
+	if err != nil || (fi.ModTime().Equal(d.modTime) && fi.Size() == d.size) {
+		return
+	}
+	data, err := ioutil.ReadFile(ds.filename)
+	if err != nil {
+		return
+	}
+	if bytes.Equal(data, d.data) {
+		// Just touched, or written back as it was.
+		d.saw(ds.filename, data)
+		return
+	}
+	if ds.readOnly && !ds.dirty {
+		// Nothing to lose; keep up with whoever is editing it.
+		ds.load()
+		updateMainPane()
+		return
+	}
+	d.changed = true
+	Log("%q changed on disk; S or L to reload, keep yours or merge.", ds.filename)
+}
+
+// Polls files of all buffers for changes, from within the main loop of gui
+// 'g', until 'stop' is closed (which must be before 'g' is); also keeps their
+// journals up to date.
+func watchFiles(g *gocui.Gui, stop <-chan struct{}) {
+	ticker := time.NewTicker(WATCH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		g.Update(func(g *gocui.Gui) error {
+			for _, b := range buffers {
+				b.checkDisk()
+				b.writeJournal()
+			}
+			return nil
+		})
+	}
+}
+
+// Replaces tree with the file on disk as merged with it: changes made there
+// since it was loaded or saved, and changes made here, combined item by
+// item. Conflicts are left as items tagged CONFLICT_TAG.
+func (ds *dataStore) mergeFromDisk() {
+	data, err := ioutil.ReadFile(ds.filename)
+	if err != nil {
+		Log("Error reading %q: %v.", ds.filename, err)
+		return
+	}
+	plain, err := ds.decrypt(data)
+	var theirs fileTree
+	if err == nil {
+		theirs, err = parseTree(plain)
+	}
+	if err != nil {
+		Log("Error loading %q: %v.", ds.filename, err)
+		return
+	}
+	var base fileTree
+	if strings.Trim(string(ds.disk.data), whitespace) != "" {
+		if plain, err = ds.decrypt(ds.disk.data); err == nil {
+			base, err = parseTree(plain)
+		}
+		if err != nil {
+			Log("Error loading former %q: %v.", ds.filename, err)
+			return
+		}
+	}
+
+	// To stay on the same list, if it is still there.
+	listId := ds.currentList.id
+
+	result, conflicts := mergeTrees(base, ds.tree(), theirs)
+	if !carryMounts(ds.root, result.root) {
+		Log("Not merged with %q: a file mounted has changes not saved, which would be lost.",
+			ds.filename)
+		return
+	}
+	reserveNodeId(result.lastId)
+	ds.setTree(result)
+	ds.undo = nil
+	ds.linkTrail = nil
+	if n := ds.nodeById(listId); n != nil && n != ds.root {
+		ds.currentList = n
+		ds.currentItem = nil
+		if len(n.sublist) > 0 {
+			ds.setCurrentItemUsingIndex(0)
+		}
+	}
+	ds.disk.saw(ds.filename, data)
+	ds.dirty = true
+
+	if conflicts > 0 {
+		Log("Merged with %q: %d conflict(s), see items tagged %s.",
+			ds.filename, conflicts, CONFLICT_TAG)
+	} else {
+		Log("Merged with %q.", ds.filename)
+	}
+}
+
+// Whether file has changed on disk, as checked right now.
+func (ds *dataStore) changedOnDisk() bool {
+	ds.checkDisk()
+	return ds.disk.changed
+}
+
+// For when quitting outside the GUI: asks whether to overwrite the file
+// anyway.
+func (ds *dataStore) confirmOverwrite() bool {
+	fmt.Printf("%q changed on disk; overwrite it? [y/n] ", ds.filename)
+	return strings.HasPrefix(readString(), "y")
+}
+
+// vim: fdm=syntax